@@ -1,50 +1,134 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
-	"net"
 
 	"github.com/cilium/cilium/pkg/mac"
 	"github.com/dustin/go-humanize"
 	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/device"
 )
 
 type BandwidthStat struct {
-	Ingress string `json:"ingress"`
-	Egress  string `json:"egress"`
+	// empty for the total
+	DeviceInfo
+	Ingress        string                   `json:"ingress"`
+	Egress         string                   `json:"egress"`
+	IngressPackets string                   `json:"ingress_packets"`
+	EgressPackets  string                   `json:"egress_packets"`
+	IngressDetail  *TrafficStat             `json:"ingress_detail,omitempty"`
+	EgressDetail   *TrafficStat             `json:"egress_detail,omitempty"`
+	Interfaces     map[string]BandwidthStat `json:"interfaces,omitempty"`
 }
 
 type BandwidthResp map[string]BandwidthStat
 
-func handleBandwidth(conn net.Conn, u *usage.Usage) {
-	resp := make(BandwidthResp)
-	var ingressTotal, egressTotal uint64
+type bandwidth struct {
+	ingress, egress               uint64
+	ingressPps, egressPps         uint64
+	ingressTraffic, egressTraffic traffic
+}
 
-	u.Mutex.RLock()
-	for key, value := range u.Data {
-		ingressTotal += value.BandwidthIngress
-		egressTotal += value.BandwidthEgress
+func (b *bandwidth) add(other *bandwidth) {
+	b.ingress += other.ingress
+	b.egress += other.egress
+	b.ingressPps += other.ingressPps
+	b.egressPps += other.egressPps
+	b.ingressTraffic.add(other.ingressTraffic)
+	b.egressTraffic.add(other.egressTraffic)
+}
 
-		m := mac.Uint64MAC(key)
-		resp[m.String()] = BandwidthStat{
-			Ingress: fmt.Sprintf("%s/s", humanize.Bytes(value.BandwidthIngress)),
-			Egress:  fmt.Sprintf("%s/s", humanize.Bytes(value.BandwidthEgress)),
-		}
+func (b *bandwidth) addStat(value *usage.UsageStat) {
+	b.add(&bandwidth{
+		ingress:        value.BandwidthIngress,
+		egress:         value.BandwidthEgress,
+		ingressPps:     value.BandwidthIngressPackets,
+		egressPps:      value.BandwidthEgressPackets,
+		ingressTraffic: newTraffic(&value.BandwidthIngressTraffic),
+		egressTraffic:  newTraffic(&value.BandwidthEgressTraffic),
+	})
+}
+
+func formatBandwidth(bytes uint64) string {
+	return fmt.Sprintf("%s/s", humanize.Bytes(bytes))
+}
+
+func formatPps(packets uint64) string {
+	return fmt.Sprintf("%s pkt/s", humanize.Comma(int64(packets)))
+}
+
+func (b bandwidth) stat() BandwidthStat {
+	return BandwidthStat{
+		Ingress:        formatBandwidth(b.ingress),
+		Egress:         formatBandwidth(b.egress),
+		IngressPackets: formatPps(b.ingressPps),
+		EgressPackets:  formatPps(b.egressPps),
+		IngressDetail:  b.ingressTraffic.stat(formatBandwidth),
+		EgressDetail:   b.egressTraffic.stat(formatBandwidth),
 	}
-	u.Mutex.RUnlock()
+}
 
-	resp["total"] = BandwidthStat{
-		Ingress: fmt.Sprintf("%s/s", humanize.Bytes(ingressTotal)),
-		Egress:  fmt.Sprintf("%s/s", humanize.Bytes(egressTotal)),
+// breakdown sums up the per interface bandwidth
+// and formats it along with the per interface values
+func breakdown(ifaces map[string]*bandwidth) BandwidthStat {
+	var sum bandwidth
+	stat := make(map[string]BandwidthStat)
+
+	for iface, value := range ifaces {
+		sum.add(value)
+		stat[iface] = value.stat()
 	}
 
-	buf, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("marshaling json: %s", err)
-		return
+	ret := sum.stat()
+	ret.Interfaces = stat
+	return ret
+}
+
+// sumBandwidth totals the counters of every device and of all of them
+// by interface, the caller must hold the usage mutex if data is u.Data
+func sumBandwidth(data map[usage.UsageKey]usage.UsageStat) (macs map[uint64]map[string]*bandwidth, total map[string]*bandwidth) {
+	macs = make(map[uint64]map[string]*bandwidth)
+	total = make(map[string]*bandwidth)
+
+	for key, value := range data {
+		ifaces, ok := macs[key.HardwareAddr]
+		if !ok {
+			ifaces = make(map[string]*bandwidth)
+			macs[key.HardwareAddr] = ifaces
+		}
+		if _, ok := ifaces[key.Iface]; !ok {
+			ifaces[key.Iface] = &bandwidth{}
+		}
+		if _, ok := total[key.Iface]; !ok {
+			total[key.Iface] = &bandwidth{}
+		}
+
+		ifaces[key.Iface].addStat(&value)
+		total[key.Iface].addStat(&value)
 	}
 
-	conn.Write(buf)
+	return macs, total
+}
+
+func newBandwidthResp(macs map[uint64]map[string]*bandwidth, total map[string]*bandwidth, inv *device.Inventory) BandwidthResp {
+	resp := make(BandwidthResp)
+
+	for key, ifaces := range macs {
+		stat := breakdown(ifaces)
+		stat.DeviceInfo = deviceInfo(inv, key)
+
+		m := mac.Uint64MAC(key)
+		resp[m.String()] = stat
+	}
+	resp["total"] = breakdown(total)
+
+	return resp
+}
+
+func handleBandwidth(u *usage.Usage, inv *device.Inventory) (BandwidthResp, error) {
+	u.Mutex.RLock()
+	macs, total := sumBandwidth(u.Data)
+	u.Mutex.RUnlock()
+
+	return newBandwidthResp(macs, total, inv), nil
 }
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"sinanmohd.com/redq/device"
+)
+
+// DeviceInfo is added to the responses that list devices
+type DeviceInfo struct {
+	Name   string `json:"name,omitempty"`
+	Vendor string `json:"vendor,omitempty"`
+	// locally administered, likely a privacy address
+	Randomized bool `json:"randomized,omitempty"`
+}
+
+type DeviceStat struct {
+	DeviceInfo
+	Tags      []string `json:"tags,omitempty"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Addrs     []string `json:"addrs,omitempty"`
+	FirstSeen string   `json:"first_seen"`
+	LastSeen  string   `json:"last_seen"`
+}
+
+type DeviceListResp map[string]DeviceStat
+
+type DeviceResp map[string]ItemResult
+
+// parseDevice accepts a MAC address or the name of a device
+func parseDevice(inv *device.Inventory, value string) (uint64, error) {
+	hwAddr, err := parseMac(value)
+	if err == nil {
+		return hwAddr, nil
+	}
+
+	hwAddr, ok := inv.Lookup(value)
+	if !ok {
+		return 0, errors.New("no such mac address or device name")
+	}
+
+	return hwAddr, nil
+}
+
+func deviceInfo(inv *device.Inventory, hwAddr uint64) DeviceInfo {
+	info := inv.Info(hwAddr)
+
+	return DeviceInfo{
+		Name:       info.Name,
+		Vendor:     info.Vendor,
+		Randomized: info.Randomized,
+	}
+}
+
+func handleDeviceList(inv *device.Inventory) (DeviceListResp, error) {
+	resp := make(DeviceListResp)
+
+	for _, dev := range inv.List() {
+		stat := DeviceStat{
+			DeviceInfo: DeviceInfo{
+				Name:       dev.Name,
+				Vendor:     dev.Vendor,
+				Randomized: dev.Randomized,
+			},
+			Tags:      dev.Tags,
+			Hostname:  dev.Hostname,
+			FirstSeen: dev.FirstSeen.Format(time.DateTime),
+			LastSeen:  dev.LastSeen.Format(time.DateTime),
+		}
+		for _, addr := range dev.Addrs {
+			stat.Addrs = append(stat.Addrs, addr.String())
+		}
+
+		resp[mac.Uint64MAC(dev.HardwareAddr).String()] = stat
+	}
+
+	return resp, nil
+}
+
+// handleDeviceName expects the arguments [device, name],
+// an empty or missing name removes the current one
+func handleDeviceName(inv *device.Inventory, args []string) (DeviceResp, error) {
+	resp := make(DeviceResp)
+
+	if len(args) < 1 || len(args) > 2 {
+		return nil, invalidArgument("expected arguments [device, name]")
+	}
+	target := args[0]
+
+	err := func() error {
+		hwAddr, err := parseDevice(inv, target)
+		if err != nil {
+			return err
+		}
+
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		return inv.SetName(hwAddr, name)
+	}()
+	if err != nil {
+		resp[target] = newResult("", err)
+	} else {
+		resp[target] = newResult("named", nil)
+	}
+
+	return resp, nil
+}
+
+// handleDeviceTags expects the arguments [device, tags...],
+// the tags replace the current ones
+func handleDeviceTags(inv *device.Inventory, args []string) (DeviceResp, error) {
+	resp := make(DeviceResp)
+
+	if len(args) < 1 {
+		return nil, invalidArgument("expected arguments [device, tags...]")
+	}
+	target := args[0]
+
+	err := func() error {
+		hwAddr, err := parseDevice(inv, target)
+		if err != nil {
+			return err
+		}
+
+		return inv.SetTags(hwAddr, args[1:])
+	}()
+	if err != nil {
+		resp[target] = newResult("", err)
+	} else {
+		resp[target] = newResult("tagged", nil)
+	}
+
+	return resp, nil
+}
+
+func handleDeviceForget(inv *device.Inventory, targets []string) (DeviceResp, error) {
+	resp := make(DeviceResp)
+
+	for _, target := range targets {
+		hwAddr, err := parseDevice(inv, target)
+		if err != nil {
+			resp[target] = newResult("", err)
+			continue
+		}
+
+		err = inv.Forget(hwAddr)
+		if err != nil {
+			resp[target] = newResult("", err)
+			continue
+		}
+
+		resp[target] = newResult("forgotten", nil)
+	}
+
+	return resp, nil
+}
+
+func handleDevice(inv *device.Inventory, args []string, action string) (any, error) {
+	switch action {
+	case "", "list":
+		return handleDeviceList(inv)
+	case "name":
+		return handleDeviceName(inv, args)
+	case "tags":
+		return handleDeviceTags(inv, args)
+	case "forget":
+		return handleDeviceForget(inv, args)
+	default:
+		return nil, invalidAction("devices", action)
+	}
+}
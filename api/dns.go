@@ -1,64 +1,364 @@
 package api
 
 import (
-	"encoding/json"
-	"log"
-	"net"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/cilium/cilium/pkg/mac"
 	"sinanmohd.com/redq/dns"
 )
 
-type DnsResp map[string]string
+type DnsResp map[string]ItemResult
 
-func handleDnsBlock(conn net.Conn, d *dns.Dns, domains []string) {
+type DnsListStat struct {
+	Path      string `json:"path"`
+	Format    string `json:"format"`
+	Mode      string `json:"mode,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+	Entries   int    `json:"entries"`
+}
+
+type DnsListsResp map[string]DnsListStat
+
+type DnsCacheResp struct {
+	Enabled    bool    `json:"enabled"`
+	Hits       uint64  `json:"hits"`
+	Misses     uint64  `json:"misses"`
+	HitRatio   float64 `json:"hit_ratio"`
+	Prefetches uint64  `json:"prefetches"`
+	Evictions  uint64  `json:"evictions"`
+	Size       int     `json:"size"`
+	Capacity   int     `json:"capacity"`
+}
+
+type DnsUpstreamStat struct {
+	Queries  uint64 `json:"queries"`
+	Failures uint64 `json:"failures"`
+	// milliseconds
+	Latency float64 `json:"latency"`
+	Healthy bool    `json:"healthy"`
+	RetryAt string  `json:"retry_at,omitempty"`
+}
+
+type DnsUpstreamsResp map[string]DnsUpstreamStat
+
+type DnsPolicyStat struct {
+	Macs   []string `json:"macs,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type DnsPoliciesResp map[string]DnsPolicyStat
+
+type DnsGroupsResp map[string][]string
+
+func handleDnsBlock(d *dns.Dns, domains []string, exact bool, mode string, duration string) (DnsResp, error) {
 	resp := make(DnsResp)
 
+	expiresAt, err := parseExpiry(duration)
+	if err != nil {
+		return nil, invalidArgument("invalid duration: %s", err)
+	}
+
 	for _, domain := range domains {
-		err := d.Block(domain)
+		err := d.Block(domain, exact, mode, expiresAt)
 		if err != nil {
-			resp[domain] = err.Error()
+			resp[domain] = newResult("", err)
 		} else {
-			resp[domain] = "blocked"
+			resp[domain] = newResult(blockedStatus(expiresAt), nil)
 		}
 	}
 
-	buf, err := json.Marshal(resp)
+	return resp, nil
+}
+
+func handleDnsUnblock(d *dns.Dns, domains []string) (DnsResp, error) {
+	resp := make(DnsResp)
+
+	for _, domain := range domains {
+		err := d.Unblock(domain)
+		if err != nil {
+			resp[domain] = newResult("", err)
+		} else {
+			resp[domain] = newResult("unblocked", nil)
+		}
+	}
+
+	return resp, nil
+}
+
+// handleDnsListImport expects the arguments [name, path, format], path
+// is relative to dns.list_dir and format is optional, defaulting to
+// auto detection
+func handleDnsListImport(d *dns.Dns, args []string, mode string) (DnsResp, error) {
+	resp := make(DnsResp)
+
+	if len(args) < 2 || len(args) > 3 {
+		return nil, invalidArgument("expected arguments [name, path, format]")
+	}
+	format := dns.FormatAuto
+	if len(args) == 3 {
+		format = args[2]
+	}
+
+	count, err := d.ImportList(args[0], args[1], format, mode)
 	if err != nil {
-		log.Printf("marshaling json: %s", err)
-		return
+		resp[args[0]] = newResult("", err)
+	} else {
+		resp[args[0]] = newResult(fmt.Sprintf("imported %d entries", count), nil)
 	}
 
-	conn.Write(buf)
+	return resp, nil
 }
 
-func handleDnsUnblock(conn net.Conn, d *dns.Dns, domains []string) {
+func handleDnsListRefresh(d *dns.Dns, lists []string) (DnsResp, error) {
 	resp := make(DnsResp)
 
-	for _, domain := range domains {
-		err := d.Unblock(domain)
+	for _, list := range lists {
+		count, err := d.RefreshList(list)
 		if err != nil {
-			resp[domain] = err.Error()
+			resp[list] = newResult("", err)
 		} else {
-			resp[domain] = "unblocked"
+			resp[list] = newResult(fmt.Sprintf("imported %d entries", count), nil)
 		}
 	}
 
-	buf, err := json.Marshal(resp)
+	return resp, nil
+}
+
+func handleDnsListRemove(d *dns.Dns, lists []string) (DnsResp, error) {
+	resp := make(DnsResp)
+
+	for _, list := range lists {
+		err := d.RemoveList(list)
+		if err != nil {
+			resp[list] = newResult("", err)
+		} else {
+			resp[list] = newResult("removed", nil)
+		}
+	}
+
+	return resp, nil
+}
+
+func handleDnsLists(d *dns.Dns) (DnsListsResp, error) {
+	resp := make(DnsListsResp)
+
+	lists, err := d.Lists()
 	if err != nil {
-		log.Printf("marshaling json: %s", err)
-		return
+		return nil, internalError("reading dns lists", err)
+	}
+	for _, list := range lists {
+		resp[list.Name] = DnsListStat{
+			Path:      list.Path,
+			Format:    list.Format,
+			Mode:      list.Mode,
+			UpdatedAt: list.UpdatedAt.Format(time.DateTime),
+			Entries:   list.Entries,
+		}
+	}
+
+	return resp, nil
+}
+
+func handleDnsCache(d *dns.Dns) (DnsCacheResp, error) {
+	var resp DnsCacheResp
+
+	stat, ok := d.CacheStats()
+	if ok {
+		resp = DnsCacheResp{
+			Enabled:    true,
+			Hits:       stat.Hits,
+			Misses:     stat.Misses,
+			Prefetches: stat.Prefetches,
+			Evictions:  stat.Evictions,
+			Size:       stat.Size,
+			Capacity:   stat.Capacity,
+		}
+		if lookups := stat.Hits + stat.Misses; lookups > 0 {
+			resp.HitRatio = float64(stat.Hits) / float64(lookups)
+		}
+	}
+
+	return resp, nil
+}
+
+func handleDnsCacheFlush(d *dns.Dns) (DnsResp, error) {
+	d.FlushCache()
+
+	return DnsResp{"cache": newResult("flushed", nil)}, nil
+}
+
+func handleDnsUpstreams(d *dns.Dns) (DnsUpstreamsResp, error) {
+	resp := make(DnsUpstreamsResp)
+
+	now := time.Now()
+	for _, stat := range d.UpstreamStats() {
+		upstream := DnsUpstreamStat{
+			Queries:  stat.Queries,
+			Failures: stat.Failures,
+			Latency:  float64(stat.Latency) / float64(time.Millisecond),
+			Healthy:  !now.Before(stat.RetryAt),
+		}
+		if !upstream.Healthy {
+			upstream.RetryAt = stat.RetryAt.Format(time.DateTime)
+		}
+
+		resp[stat.Addr] = upstream
+	}
+
+	return resp, nil
+}
+
+// groupPrefix marks a policy target as a device group, so a mistyped
+// MAC address isn't silently taken for a group
+const groupPrefix = "group:"
+
+func parsePolicyTarget(target string) (dns.PolicyTarget, error) {
+	group, ok := strings.CutPrefix(target, groupPrefix)
+	if ok {
+		if group == "" {
+			return dns.PolicyTarget{}, errors.New("empty group name")
+		}
+
+		return dns.PolicyTarget{Group: group}, nil
+	}
+
+	hwAddr, err := parseMac(target)
+	if err != nil {
+		return dns.PolicyTarget{}, err
+	}
+
+	return dns.PolicyTarget{HardwareAddr: hwAddr}, nil
+}
+
+// handleDnsPolicy expects the arguments [list, targets...],
+// where every target is a MAC address or group:<name>
+func handleDnsPolicy(d *dns.Dns, args []string, add bool) (DnsResp, error) {
+	resp := make(DnsResp)
+
+	if len(args) < 2 {
+		return nil, invalidArgument("expected arguments [list, targets...]")
+	}
+
+	for _, target := range args[1:] {
+		status := "removed"
+
+		t, err := parsePolicyTarget(target)
+		if err == nil && add {
+			err = d.AddPolicy(args[0], t)
+			status = "added"
+		} else if err == nil {
+			err = d.RemovePolicy(args[0], t)
+		}
+
+		if err != nil {
+			resp[target] = newResult("", err)
+		} else {
+			resp[target] = newResult(status, nil)
+		}
+	}
+
+	return resp, nil
+}
+
+func handleDnsPolicies(d *dns.Dns) (DnsPoliciesResp, error) {
+	resp := make(DnsPoliciesResp)
+
+	for list, policy := range d.Policies() {
+		var stat DnsPolicyStat
+		for _, hwAddr := range policy.HardwareAddrs {
+			stat.Macs = append(stat.Macs, mac.Uint64MAC(hwAddr).String())
+		}
+		stat.Groups = policy.Groups
+
+		resp[list] = stat
+	}
+
+	return resp, nil
+}
+
+// handleDnsGroup expects the arguments [group, macs...]
+func handleDnsGroup(d *dns.Dns, args []string, add bool) (DnsResp, error) {
+	resp := make(DnsResp)
+
+	if len(args) < 2 {
+		return nil, invalidArgument("expected arguments [group, macs...]")
+	}
+
+	for _, macString := range args[1:] {
+		hwAddr, err := parseMac(macString)
+		if err != nil {
+			resp[macString] = newResult("", err)
+			continue
+		}
+
+		status := "removed"
+		if add {
+			err = d.AddToGroup(args[0], hwAddr)
+			status = "added"
+		} else {
+			err = d.RemoveFromGroup(args[0], hwAddr)
+		}
+
+		if err != nil {
+			resp[macString] = newResult("", err)
+		} else {
+			resp[macString] = newResult(status, nil)
+		}
+	}
+
+	return resp, nil
+}
+
+func handleDnsGroups(d *dns.Dns) (DnsGroupsResp, error) {
+	resp := make(DnsGroupsResp)
+
+	for group, hwAddrs := range d.Groups() {
+		for _, hwAddr := range hwAddrs {
+			resp[group] = append(resp[group], mac.Uint64MAC(hwAddr).String())
+		}
 	}
 
-	conn.Write(buf)
+	return resp, nil
 }
 
-func handleDns(conn net.Conn, d *dns.Dns, domains []string, action string) {
-	switch action {
+func handleDns(d *dns.Dns, req *ApiReq) (any, error) {
+	switch req.Action {
 	case "block":
-		handleDnsBlock(conn, d, domains)
+		return handleDnsBlock(d, req.Arg, false, req.Mode, req.Duration)
+	case "block-exact":
+		return handleDnsBlock(d, req.Arg, true, req.Mode, req.Duration)
 	case "unblock":
-		handleDnsUnblock(conn, d, domains)
+		return handleDnsUnblock(d, req.Arg)
+	case "list-import":
+		return handleDnsListImport(d, req.Arg, req.Mode)
+	case "list-refresh":
+		return handleDnsListRefresh(d, req.Arg)
+	case "list-remove":
+		return handleDnsListRemove(d, req.Arg)
+	case "lists":
+		return handleDnsLists(d)
+	case "cache":
+		return handleDnsCache(d)
+	case "cache-flush":
+		return handleDnsCacheFlush(d)
+	case "upstreams":
+		return handleDnsUpstreams(d)
+	case "policy-add":
+		return handleDnsPolicy(d, req.Arg, true)
+	case "policy-remove":
+		return handleDnsPolicy(d, req.Arg, false)
+	case "policies":
+		return handleDnsPolicies(d)
+	case "group-add":
+		return handleDnsGroup(d, req.Arg, true)
+	case "group-remove":
+		return handleDnsGroup(d, req.Arg, false)
+	case "groups":
+		return handleDnsGroups(d)
 	default:
-		log.Printf("handling dns: invalid action '%s'", action)
+		return nil, invalidAction("dns", req.Action)
 	}
 }
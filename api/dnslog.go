@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"sinanmohd.com/redq/dns"
+)
+
+type DnsLogEntry struct {
+	Time    string `json:"time"`
+	Client  string `json:"client"`
+	Mac     string `json:"mac,omitempty"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Rcode   string `json:"rcode"`
+	Blocked bool   `json:"blocked"`
+	// empty for blocked and cached responses
+	Upstream string `json:"upstream,omitempty"`
+	// milliseconds
+	Latency float64 `json:"latency"`
+}
+
+type DnsLogResp []DnsLogEntry
+
+// parseDnsLogSearch parses the [from, to, client, domain] arguments of a
+// dnslog request, every argument is optional and empty ones match anything.
+// client is either an IP or a MAC address
+func parseDnsLogSearch(args []string) (dns.LogSearch, error) {
+	var s dns.LogSearch
+	var err error
+
+	if len(args) > 4 {
+		return s, errors.New("expected arguments [from, to, client, domain]")
+	}
+	args = append(args, make([]string, 4-len(args))...)
+
+	if args[0] != "" {
+		s.Start, err = parseTime(args[0])
+		if err != nil {
+			return s, err
+		}
+	}
+	if args[1] != "" {
+		s.Stop, err = parseTime(args[1])
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if args[2] != "" {
+		s.Client, err = netip.ParseAddr(args[2])
+		if err != nil {
+			s.HardwareAddr, err = parseMac(args[2])
+			if err != nil {
+				return s, errors.New("client must be an IP or a MAC address")
+			}
+		}
+	}
+	s.Name = args[3]
+
+	return s, nil
+}
+
+func handleDnsLog(d *dns.Dns, args []string) (DnsLogResp, error) {
+	resp := make(DnsLogResp, 0)
+
+	s, err := parseDnsLogSearch(args)
+	if err != nil {
+		return nil, invalidArgument("%s", err)
+	}
+
+	entries, err := d.SearchLog(s)
+	if errors.Is(err, dns.ErrLogDisabled) {
+		return nil, newError(ErrUnavailable, "%s", err)
+	} else if err != nil {
+		return nil, internalError("searching dns log", err)
+	}
+	for _, entry := range entries {
+		e := DnsLogEntry{
+			Time:     entry.Time.Format(time.DateTime),
+			Client:   entry.Client.String(),
+			Name:     entry.Name,
+			Type:     entry.Type,
+			Rcode:    entry.Rcode,
+			Blocked:  entry.Blocked,
+			Upstream: entry.Upstream,
+			Latency:  float64(entry.Latency) / float64(time.Millisecond),
+		}
+		if entry.HardwareAddr != 0 {
+			e.Mac = mac.Uint64MAC(entry.HardwareAddr).String()
+		}
+
+		resp = append(resp, e)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+)
+
+// status codes of a response, they follow their HTTP counterparts
+const (
+	StatusOk                 = 200
+	StatusBadRequest         = 400
+	StatusNotFound           = 404
+	StatusRequestTimeout     = 408
+	StatusInternalError      = 500
+	StatusServiceUnavailable = 503
+)
+
+// machine readable error codes, messages are meant for people
+// and may change but codes are stable within a protocol version
+const (
+	ErrInvalidJson        = "invalid_json"
+	ErrTooLarge           = "too_large"
+	ErrTimeout            = "timeout"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrInvalidType        = "invalid_type"
+	ErrInvalidAction      = "invalid_action"
+	ErrInvalidArgument    = "invalid_argument"
+	ErrUnavailable        = "unavailable"
+	ErrInternal           = "internal"
+)
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ApiError) status() int {
+	switch e.Code {
+	case ErrInvalidType, ErrInvalidAction:
+		return StatusNotFound
+	case ErrTimeout:
+		return StatusRequestTimeout
+	case ErrInternal:
+		return StatusInternalError
+	case ErrUnavailable:
+		return StatusServiceUnavailable
+	default:
+		return StatusBadRequest
+	}
+}
+
+func newError(code string, format string, a ...any) error {
+	return &ApiError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func invalidArgument(format string, a ...any) error {
+	return newError(ErrInvalidArgument, format, a...)
+}
+
+func invalidAction(reqType string, action string) error {
+	return newError(ErrInvalidAction, "invalid %s action '%s'", reqType, action)
+}
+
+// internalError wraps the failures the client can't do anything about
+func internalError(what string, err error) error {
+	return newError(ErrInternal, "%s: %s", what, err)
+}
+
+// ItemResult is the outcome for one of the items a request acts on,
+// the request succeeds even if some of its items fail
+type ItemResult struct {
+	Status int       `json:"status"`
+	Result string    `json:"result,omitempty"`
+	Error  *ApiError `json:"error,omitempty"`
+}
+
+// newResult reports the outcome of an item, errors other
+// than ApiErrors are the item being rejected
+func newResult(result string, err error) ItemResult {
+	if err == nil {
+		return ItemResult{
+			Status: StatusOk,
+			Result: result,
+		}
+	}
+
+	apiErr, ok := err.(*ApiError)
+	if !ok {
+		apiErr = &ApiError{
+			Code:    ErrInvalidArgument,
+			Message: err.Error(),
+		}
+	}
+
+	return ItemResult{
+		Status: apiErr.status(),
+		Error:  apiErr,
+	}
+}
@@ -1,91 +1,225 @@
 package api
 
 import (
-	"encoding/json"
-	"log"
-	"net"
+	"net/netip"
+	"strings"
 
 	"github.com/cilium/cilium/pkg/mac"
 	"sinanmohd.com/redq/bpf/filter"
+	"sinanmohd.com/redq/device"
 )
 
-type FilterResp map[string]string
+type FilterResp map[string]ItemResult
 
-func handleFilterBlock(conn net.Conn, f *filter.Filter, macs []string) {
+type FilterModeResp struct {
+	Mode string `json:"mode"`
+	// the mode is shared by every filtered interface
+	Interfaces []string `json:"interfaces"`
+}
+
+func handleFilterBlock(f *filter.Filter, inv *device.Inventory, macs []string, duration string) (FilterResp, error) {
 	resp := make(FilterResp)
 
+	expiresAt, err := parseExpiry(duration)
+	if err != nil {
+		return nil, invalidArgument("invalid duration: %s", err)
+	}
+
 	for _, mac_string := range macs {
-		mac, err := mac.ParseMAC(mac_string)
+		hwAddr, err := parseDevice(inv, mac_string)
 		if err != nil {
-			resp[mac_string] = err.Error()
+			resp[mac_string] = newResult("", err)
 			continue
 		}
 
-		mac_cilium64, err := mac.Uint64()
+		err = f.Block(hwAddr, expiresAt)
 		if err != nil {
-			resp[mac_string] = err.Error()
+			resp[mac_string] = newResult("", internalError("blocking", err))
 			continue
 		}
 
-		err = f.Block(uint64(mac_cilium64))
+		resp[mac_string] = newResult(blockedStatus(expiresAt), nil)
+	}
+
+	return resp, nil
+}
+
+func handleFilterUnblock(f *filter.Filter, inv *device.Inventory, macs []string) (FilterResp, error) {
+	resp := make(FilterResp)
+
+	for _, mac_string := range macs {
+		hwAddr, err := parseDevice(inv, mac_string)
 		if err != nil {
-			resp[mac_string] = err.Error()
+			resp[mac_string] = newResult("", err)
 			continue
 		}
 
-		resp[mac_string] = "blocked"
-	}
+		err = f.Unblock(hwAddr)
+		if err != nil {
+			resp[mac_string] = newResult("", internalError("unblocking", err))
+			continue
+		}
 
-	buf, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("marshaling json: %s", err)
-		return
+		resp[mac_string] = newResult("unblocked", nil)
 	}
 
-	conn.Write(buf)
+	return resp, nil
 }
 
-func handleFilterUnblock(conn net.Conn, f *filter.Filter, macs []string) {
+func handleFilterAllow(f *filter.Filter, inv *device.Inventory, macs []string, allow bool) (FilterResp, error) {
 	resp := make(FilterResp)
 
 	for _, mac_string := range macs {
-		mac, err := mac.ParseMAC(mac_string)
+		hwAddr, err := parseDevice(inv, mac_string)
 		if err != nil {
-			resp[mac_string] = err.Error()
+			resp[mac_string] = newResult("", err)
 			continue
 		}
 
-		mac_cilium64, err := mac.Uint64()
+		if allow {
+			err = f.Allow(hwAddr)
+		} else {
+			err = f.Disallow(hwAddr)
+		}
 		if err != nil {
-			resp[mac_string] = err.Error()
+			resp[mac_string] = newResult("", internalError("updating allowlist", err))
 			continue
 		}
 
-		err = f.Unblock(uint64(mac_cilium64))
+		if allow {
+			resp[mac_string] = newResult("allowed", nil)
+		} else {
+			resp[mac_string] = newResult("disallowed", nil)
+		}
+	}
+
+	return resp, nil
+}
+
+func handleFilterAllowed(f *filter.Filter) ([]string, error) {
+	resp := []string{}
+
+	for _, hwAddr := range f.Allowed() {
+		resp = append(resp, mac.Uint64MAC(hwAddr).String())
+	}
+
+	return resp, nil
+}
+
+// handleFilterMode switches to the allowlist or blacklist mode if
+// given one, and reports the current mode and the interfaces it covers
+func handleFilterMode(f *filter.Filter, args []string) (FilterModeResp, error) {
+	var resp FilterModeResp
+
+	if len(args) > 1 {
+		return resp, invalidArgument("expected arguments [mode]")
+	}
+
+	if len(args) == 1 {
+		var err error
+
+		switch args[0] {
+		case "allowlist":
+			// the filter refuses it too, this tells
+			// the client it's their request at fault
+			if len(f.Allowed()) == 0 {
+				return resp, invalidArgument("allowlist is empty, allow a device first")
+			}
+			err = f.SetAllowlist(true)
+		case "blacklist":
+			err = f.SetAllowlist(false)
+		default:
+			return resp, invalidArgument("invalid mode '%s'", args[0])
+		}
 		if err != nil {
-			resp[mac_string] = err.Error()
+			return resp, internalError("setting filter mode", err)
+		}
+	}
+
+	resp.Mode = "blacklist"
+	if f.Allowlist() {
+		resp.Mode = "allowlist"
+	}
+	resp.Interfaces = f.Interfaces()
+
+	return resp, nil
+}
+
+// parsePrefix accepts a CIDR prefix or a bare address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	return netip.ParsePrefix(value)
+}
+
+func handleFilterCidr(f *filter.Filter, prefixes []string, block bool) (FilterResp, error) {
+	resp := make(FilterResp)
+
+	for _, prefix_string := range prefixes {
+		prefix, err := parsePrefix(prefix_string)
+		if err != nil {
+			resp[prefix_string] = newResult("", err)
+			continue
+		}
+
+		if block {
+			err = f.BlockCIDR(prefix)
+		} else {
+			err = f.UnblockCIDR(prefix)
+		}
+		if err != nil {
+			resp[prefix_string] = newResult("", err)
 			continue
 		}
 
-		resp[mac_string] = "unblocked"
+		if block {
+			resp[prefix_string] = newResult("blocked", nil)
+		} else {
+			resp[prefix_string] = newResult("unblocked", nil)
+		}
 	}
 
-	buf, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("marshaling json: %s", err)
-		return
+	return resp, nil
+}
+
+func handleFilterCidrs(f *filter.Filter) ([]string, error) {
+	resp := []string{}
+
+	for _, prefix := range f.BlockedCIDRs() {
+		resp = append(resp, prefix.String())
 	}
 
-	conn.Write(buf)
+	return resp, nil
 }
 
-func handleFilter(conn net.Conn, f *filter.Filter, macs []string, action string) {
+func handleFilter(f *filter.Filter, inv *device.Inventory, macs []string, action string, duration string) (any, error) {
 	switch action {
 	case "block":
-		handleFilterBlock(conn, f, macs)
+		return handleFilterBlock(f, inv, macs, duration)
 	case "unblock":
-		handleFilterUnblock(conn, f, macs)
+		return handleFilterUnblock(f, inv, macs)
+	case "block-cidr":
+		return handleFilterCidr(f, macs, true)
+	case "unblock-cidr":
+		return handleFilterCidr(f, macs, false)
+	case "cidrs":
+		return handleFilterCidrs(f)
+	case "allow":
+		return handleFilterAllow(f, inv, macs, true)
+	case "disallow":
+		return handleFilterAllow(f, inv, macs, false)
+	case "allowed":
+		return handleFilterAllowed(f)
+	case "mode":
+		return handleFilterMode(f, macs)
 	default:
-		log.Printf("handling dns: invalid action '%s'", action)
+		return nil, invalidAction("filter", action)
 	}
 }
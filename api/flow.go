@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strconv"
+	"syscall"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"github.com/dustin/go-humanize"
+	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/device"
+)
+
+type FlowStat struct {
+	Ingress        string `json:"ingress"`
+	Egress         string `json:"egress"`
+	IngressPackets string `json:"ingress_packets"`
+	EgressPackets  string `json:"egress_packets"`
+}
+
+type FlowTalker struct {
+	Mac string `json:"mac"`
+	DeviceInfo
+	FlowStat
+}
+
+type FlowDestination struct {
+	// address and port, just the address for protocols without ports
+	Remote string `json:"remote"`
+	Proto  string `json:"proto"`
+	FlowStat
+}
+
+func flowStat(stat *usage.FlowStat) FlowStat {
+	return FlowStat{
+		Ingress:        humanize.Bytes(stat.Ingress),
+		Egress:         humanize.Bytes(stat.Egress),
+		IngressPackets: humanize.Comma(int64(stat.IngressPackets)),
+		EgressPackets:  humanize.Comma(int64(stat.EgressPackets)),
+	}
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_ICMP:
+		return "icmp"
+	case syscall.IPPROTO_ICMPV6:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// parseFlowSearch parses the [from, to, mac] arguments of
+// a flows request, mac is optional and may be a device name
+func parseFlowSearch(inv *device.Inventory, args []string) (usage.FlowSearch, error) {
+	var s usage.FlowSearch
+	var err error
+
+	if len(args) < 2 || len(args) > 3 {
+		return s, errors.New("expected arguments [from, to, mac]")
+	}
+
+	s.Start, err = parseTime(args[0])
+	if err != nil {
+		return s, err
+	}
+	s.Stop, err = parseTime(args[1])
+	if err != nil {
+		return s, err
+	}
+	if !s.Start.Before(s.Stop) {
+		return s, errors.New("from must be before to")
+	}
+
+	if len(args) == 3 {
+		s.HardwareAddr, err = parseDevice(inv, args[2])
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+func handleFlowTalkers(u *usage.Usage, inv *device.Inventory, queries *db.Queries, ctxDb context.Context, s usage.FlowSearch) ([]FlowTalker, error) {
+	resp := []FlowTalker{}
+
+	talkers, err := u.TopTalkers(queries, ctxDb, s)
+	if errors.Is(err, usage.ErrFlowsDisabled) {
+		return nil, newError(ErrUnavailable, "%s", err)
+	} else if err != nil {
+		return nil, internalError("reading flows", err)
+	}
+	for _, talker := range talkers {
+		resp = append(resp, FlowTalker{
+			Mac:        mac.Uint64MAC(talker.HardwareAddr).String(),
+			DeviceInfo: deviceInfo(inv, talker.HardwareAddr),
+			FlowStat:   flowStat(&talker.FlowStat),
+		})
+	}
+
+	return resp, nil
+}
+
+func handleFlowDestinations(u *usage.Usage, queries *db.Queries, ctxDb context.Context, s usage.FlowSearch) ([]FlowDestination, error) {
+	resp := []FlowDestination{}
+
+	destinations, err := u.TopDestinations(queries, ctxDb, s)
+	if errors.Is(err, usage.ErrFlowsDisabled) {
+		return nil, newError(ErrUnavailable, "%s", err)
+	} else if err != nil {
+		return nil, internalError("reading flows", err)
+	}
+	for _, destination := range destinations {
+		remote := destination.Remote.String()
+		if destination.RemotePort != 0 {
+			remote = netip.AddrPortFrom(destination.Remote, destination.RemotePort).String()
+		}
+
+		resp = append(resp, FlowDestination{
+			Remote:   remote,
+			Proto:    protoName(destination.Proto),
+			FlowStat: flowStat(&destination.FlowStat),
+		})
+	}
+
+	return resp, nil
+}
+
+func handleFlow(u *usage.Usage, inv *device.Inventory, queries *db.Queries, ctxDb context.Context, args []string, action string) (any, error) {
+	s, err := parseFlowSearch(inv, args)
+	if err != nil {
+		return nil, invalidArgument("%s", err)
+	}
+
+	switch action {
+	case "talkers":
+		return handleFlowTalkers(u, inv, queries, ctxDb, s)
+	case "destinations":
+		return handleFlowDestinations(u, queries, ctxDb, s)
+	default:
+		return nil, invalidAction("flows", action)
+	}
+}
@@ -1,41 +1,83 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"os"
+	"time"
 
+	"github.com/cilium/cilium/pkg/mac"
 	"sinanmohd.com/redq/bpf/filter"
 	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/config"
 	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/device"
 	"sinanmohd.com/redq/dns"
+	"sinanmohd.com/redq/event"
+	"sinanmohd.com/redq/quota"
+	"sinanmohd.com/redq/ratelimit"
+	"sinanmohd.com/redq/schedule"
 )
 
 const (
-	sockPath = "/tmp/redq_ebpf.sock"
-	bufSize  = 4096
+	// size of the read buffer, requests grow past it up to maxReqSize
+	bufSize    = 4096
+	maxReqSize = 16 * 1024 * 1024
+	// Version of the protocol, bumped on incompatible changes
+	Version = 1
 )
 
 type ApiReq struct {
+	// zero for the current version
+	Version int `json:"version,omitempty"`
+	// echoed back in the response
+	Id     string   `json:"id,omitempty"`
 	Type   string   `json:"type"`
 	Action string   `json:"action"`
 	Arg    []string `json:"arg"`
+	// dns block mode, empty for the configured default
+	Mode string `json:"mode,omitempty"`
+	// how long a block lasts like 1h30m, empty for good
+	Duration string `json:"duration,omitempty"`
+}
+
+// ApiResp wraps every response, Data is set when Status
+// is StatusOk and Error otherwise
+type ApiResp struct {
+	Version int       `json:"version"`
+	Id      string    `json:"id,omitempty"`
+	Status  int       `json:"status"`
+	Error   *ApiError `json:"error,omitempty"`
+	// set on the responses streamed to subscribers
+	Event   string `json:"event,omitempty"`
+	Dropped uint64 `json:"dropped,omitempty"`
+	Data    any    `json:"data,omitempty"`
 }
 
 type Api struct {
-	sock net.Listener
+	sock         net.Listener
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
 func Close(a *Api) {
 	a.sock.Close()
 }
 
-func New() (*Api, error) {
+func New(cfg *config.Config) (*Api, error) {
 	var err error
-	var a Api
+	a := Api{
+		idleTimeout:  cfg.Api.IdleTimeout,
+		writeTimeout: cfg.Api.WriteTimeout,
+	}
 
-	a.sock, err = net.Listen("unix", sockPath)
+	a.sock, err = net.Listen("unix", cfg.Api.SockPath)
 	if err != nil {
 		log.Printf("listening on unix socket: %s", err)
 		return nil, err
@@ -44,7 +86,7 @@ func New() (*Api, error) {
 	return &a, nil
 }
 
-func (a *Api) Run(u *usage.Usage, d *dns.Dns, f *filter.Filter, queries *db.Queries, ctxDb context.Context) {
+func (a *Api) Run(u *usage.Usage, d *dns.Dns, f *filter.Filter, q *quota.Quota, s *schedule.Schedule, r *ratelimit.RateLimit, inv *device.Inventory, b *event.Bus, queries *db.Queries, ctxDb context.Context) {
 	for {
 		conn, err := a.sock.Accept()
 		if err != nil {
@@ -52,37 +94,196 @@ func (a *Api) Run(u *usage.Usage, d *dns.Dns, f *filter.Filter, queries *db.Quer
 			continue
 		}
 
-		go handleConn(conn, u, d, f, queries, ctxDb)
+		go a.handleConn(conn, u, d, f, q, s, r, inv, b, queries, ctxDb)
 	}
 }
 
-func handleConn(conn net.Conn, u *usage.Usage, d *dns.Dns, f *filter.Filter, queries *db.Queries, ctxDb context.Context) {
-	defer conn.Close()
-	var req ApiReq
-	buf := make([]byte, bufSize)
+func parseMac(macString string) (uint64, error) {
+	m, err := mac.ParseMAC(macString)
+	if err != nil {
+		return 0, err
+	}
 
-	count, err := conn.Read(buf)
+	macCilium64, err := m.Uint64()
 	if err != nil {
-		log.Printf("reading to buffer: %s", err)
-		return
+		return 0, err
 	}
 
-	err = json.Unmarshal(buf[:count], &req)
+	return uint64(macCilium64), nil
+}
+
+// parseExpiry returns when a block of the given duration
+// expires, the zero time if the duration is empty
+func parseExpiry(duration string) (time.Time, error) {
+	if duration == "" {
+		return time.Time{}, nil
+	}
+
+	d, err := time.ParseDuration(duration)
 	if err != nil {
-		log.Printf("unmarshaling json: %s", err)
-		return
+		return time.Time{}, err
+	}
+	if d <= 0 {
+		return time.Time{}, errors.New("duration must be positive")
+	}
+
+	return time.Now().Add(d), nil
+}
+
+// blockedStatus is the response to a successful block
+func blockedStatus(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return "blocked"
+	}
+
+	return "blocked until " + expiresAt.Format(time.DateTime)
+}
+
+func handleReq(req *ApiReq, u *usage.Usage, d *dns.Dns, f *filter.Filter, q *quota.Quota, s *schedule.Schedule, r *ratelimit.RateLimit, inv *device.Inventory, queries *db.Queries, ctxDb context.Context) (any, error) {
+	if req.Version > Version {
+		return nil, newError(ErrUnsupportedVersion, "version %d is newer than %d", req.Version, Version)
 	}
 
 	switch req.Type {
 	case "bandwidth":
-		handleBandwidth(conn, u)
+		return handleBandwidth(u, inv)
 	case "usage":
-		handleUsage(conn, u, queries, ctxDb)
+		return handleUsage(u, inv, queries, ctxDb, req.Arg, req.Action)
 	case "dns":
-		handleDns(conn, d, req.Arg, req.Action)
+		return handleDns(d, req)
+	case "dnslog":
+		return handleDnsLog(d, req.Arg)
 	case "filter":
-		handleFilter(conn, f, req.Arg, req.Action)
+		return handleFilter(f, inv, req.Arg, req.Action, req.Duration)
+	case "quota":
+		return handleQuota(q, inv, req.Arg, req.Action)
+	case "schedule":
+		return handleSchedule(s, req.Arg, req.Action)
+	case "flows":
+		return handleFlow(u, inv, queries, ctxDb, req.Arg, req.Action)
+	case "ratelimit":
+		return handleRateLimit(r, inv, req.Arg, req.Action)
+	case "devices":
+		return handleDevice(inv, req.Arg, req.Action)
 	default:
-		log.Printf("invalid request type: %s", req.Type)
+		return nil, newError(ErrInvalidType, "invalid request type '%s'", req.Type)
+	}
+}
+
+// newResp wraps the result of a request
+func newResp(id string, data any, err error) ApiResp {
+	resp := ApiResp{
+		Version: Version,
+		Id:      id,
+		Status:  StatusOk,
+	}
+	if err == nil {
+		resp.Data = data
+		return resp
+	}
+
+	apiErr, ok := err.(*ApiError)
+	if !ok {
+		apiErr = &ApiError{
+			Code:    ErrInternal,
+			Message: err.Error(),
+		}
+	}
+	resp.Status = apiErr.status()
+	resp.Error = apiErr
+
+	return resp
+}
+
+func (a *Api) handleConn(conn net.Conn, u *usage.Usage, d *dns.Dns, f *filter.Filter, q *quota.Quota, s *schedule.Schedule, r *ratelimit.RateLimit, inv *device.Inventory, b *event.Bus, queries *db.Queries, ctxDb context.Context) {
+	defer conn.Close()
+
+	// every line is a request, and every response is written as a line
+	// in the same order. the last request may go without a newline
+	reader := bufio.NewReaderSize(conn, bufSize)
+	for {
+		var req ApiReq
+		var resp ApiResp
+
+		conn.SetReadDeadline(time.Now().Add(a.idleTimeout))
+		line, readErr := readLine(reader)
+		pending := len(bytes.TrimSpace(line)) > 0
+		switch {
+		case errors.Is(readErr, bufio.ErrTooLong):
+			resp = newResp("", nil, newError(ErrTooLarge, "request is larger than %d bytes", maxReqSize))
+			a.write(conn, &resp)
+			return
+		case errors.Is(readErr, os.ErrDeadlineExceeded):
+			// an idle connection is closed quietly, but a client
+			// stuck on a request without its newline is told why
+			if pending {
+				resp = newResp("", nil, newError(ErrTimeout, "request wasn't finished with a newline within %s", a.idleTimeout))
+				a.write(conn, &resp)
+			}
+			return
+		case readErr != nil && !errors.Is(readErr, io.EOF):
+			log.Printf("reading request: %s", readErr)
+			return
+		}
+		if !pending {
+			if readErr != nil {
+				return
+			}
+			continue
+		}
+
+		err := json.Unmarshal(line, &req)
+		if err != nil {
+			resp = newResp("", nil, newError(ErrInvalidJson, "%s", err))
+		} else if req.Type == "subscribe" && req.Version <= Version {
+			a.subscribe(conn, reader, &req, inv, b)
+			return
+		} else {
+			data, err := handleReq(&req, u, d, f, q, s, r, inv, queries, ctxDb)
+			resp = newResp(req.Id, data, err)
+		}
+		if resp.Error != nil {
+			log.Printf("handling request: %s", resp.Error)
+		}
+
+		err = a.write(conn, &resp)
+		if err != nil || readErr != nil {
+			return
+		}
 	}
 }
+
+// readLine reads up to and including a newline, on errors the
+// part of the line read so far is returned along with the error
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxReqSize {
+			return line, bufio.ErrTooLong
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// write sends a response followed by a newline
+func (a *Api) write(conn net.Conn, resp *ApiResp) error {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("marshaling json: %s", err)
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(a.writeTimeout))
+	_, err = conn.Write(append(buf, '\n'))
+	if err != nil {
+		log.Printf("writing response: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"github.com/dustin/go-humanize"
+	"sinanmohd.com/redq/device"
+	"sinanmohd.com/redq/quota"
+)
+
+type QuotaStat struct {
+	DeviceInfo
+	Bytes   string `json:"bytes"`
+	Period  string `json:"period"`
+	Used    string `json:"used"`
+	Blocked bool   `json:"blocked"`
+}
+
+type QuotaListResp map[string]QuotaStat
+
+type QuotaResp map[string]ItemResult
+
+// handleQuotaSet expects the arguments [mac, bytes, period],
+// bytes is in human readable form like 10GB
+func handleQuotaSet(q *quota.Quota, inv *device.Inventory, args []string) (QuotaResp, error) {
+	resp := make(QuotaResp)
+
+	if len(args) != 3 {
+		return nil, invalidArgument("expected arguments [mac, bytes, period]")
+	}
+	macString := args[0]
+
+	err := func() error {
+		mac, err := parseDevice(inv, macString)
+		if err != nil {
+			return err
+		}
+
+		bytes, err := humanize.ParseBytes(args[1])
+		if err != nil {
+			return err
+		}
+		if bytes == 0 {
+			return errors.New("quota must be larger than zero")
+		}
+
+		return q.Set(mac, bytes, args[2])
+	}()
+	if err != nil {
+		resp[macString] = newResult("", err)
+	} else {
+		resp[macString] = newResult("set", nil)
+	}
+
+	return resp, nil
+}
+
+func handleQuotaList(q *quota.Quota, inv *device.Inventory) (QuotaListResp, error) {
+	resp := make(QuotaListResp)
+
+	for key, value := range q.List() {
+		m := mac.Uint64MAC(key)
+		resp[m.String()] = QuotaStat{
+			DeviceInfo: deviceInfo(inv, key),
+			Bytes:      humanize.Bytes(value.Bytes),
+			Period:     value.Period,
+			Used:       humanize.Bytes(value.Used),
+			Blocked:    value.Blocked,
+		}
+	}
+
+	return resp, nil
+}
+
+func handleQuotaClear(q *quota.Quota, inv *device.Inventory, macs []string) (QuotaResp, error) {
+	resp := make(QuotaResp)
+
+	for _, macString := range macs {
+		mac, err := parseDevice(inv, macString)
+		if err != nil {
+			resp[macString] = newResult("", err)
+			continue
+		}
+
+		err = q.Clear(mac)
+		if err != nil {
+			resp[macString] = newResult("", err)
+			continue
+		}
+
+		resp[macString] = newResult("cleared", nil)
+	}
+
+	return resp, nil
+}
+
+func handleQuota(q *quota.Quota, inv *device.Inventory, args []string, action string) (any, error) {
+	switch action {
+	case "set":
+		return handleQuotaSet(q, inv, args)
+	case "list":
+		return handleQuotaList(q, inv)
+	case "clear":
+		return handleQuotaClear(q, inv, args)
+	default:
+		return nil, invalidAction("quota", action)
+	}
+}
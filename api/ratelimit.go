@@ -0,0 +1,116 @@
+package api
+
+import (
+	"github.com/cilium/cilium/pkg/mac"
+	"github.com/dustin/go-humanize"
+	"sinanmohd.com/redq/device"
+	"sinanmohd.com/redq/ratelimit"
+)
+
+type RateLimitStat struct {
+	DeviceInfo
+	Ingress string `json:"ingress"`
+	Egress  string `json:"egress"`
+}
+
+type RateLimitListResp map[string]RateLimitStat
+
+type RateLimitResp map[string]ItemResult
+
+// formatRate reports zero as no limit
+func formatRate(rate uint64) string {
+	if rate == 0 {
+		return "none"
+	}
+
+	return humanize.Bytes(rate) + "/s"
+}
+
+// handleRateLimitSet expects the arguments [mac, ingress, egress] in
+// bytes per second like 2MB, 0 leaves a direction unlimited
+func handleRateLimitSet(r *ratelimit.RateLimit, inv *device.Inventory, args []string) (RateLimitResp, error) {
+	resp := make(RateLimitResp)
+
+	if len(args) != 3 {
+		return nil, invalidArgument("expected arguments [mac, ingress, egress]")
+	}
+	macString := args[0]
+
+	err := func() error {
+		mac, err := parseDevice(inv, macString)
+		if err != nil {
+			return err
+		}
+
+		ingress, err := humanize.ParseBytes(args[1])
+		if err != nil {
+			return err
+		}
+		egress, err := humanize.ParseBytes(args[2])
+		if err != nil {
+			return err
+		}
+
+		return r.Set(mac, ratelimit.RateLimitStat{
+			Ingress: ingress,
+			Egress:  egress,
+		})
+	}()
+	if err != nil {
+		resp[macString] = newResult("", err)
+	} else {
+		resp[macString] = newResult("set", nil)
+	}
+
+	return resp, nil
+}
+
+func handleRateLimitList(r *ratelimit.RateLimit, inv *device.Inventory) (RateLimitListResp, error) {
+	resp := make(RateLimitListResp)
+
+	for key, value := range r.List() {
+		m := mac.Uint64MAC(key)
+		resp[m.String()] = RateLimitStat{
+			DeviceInfo: deviceInfo(inv, key),
+			Ingress:    formatRate(value.Ingress),
+			Egress:     formatRate(value.Egress),
+		}
+	}
+
+	return resp, nil
+}
+
+func handleRateLimitRemove(r *ratelimit.RateLimit, inv *device.Inventory, macs []string) (RateLimitResp, error) {
+	resp := make(RateLimitResp)
+
+	for _, macString := range macs {
+		mac, err := parseDevice(inv, macString)
+		if err != nil {
+			resp[macString] = newResult("", err)
+			continue
+		}
+
+		err = r.Remove(mac)
+		if err != nil {
+			resp[macString] = newResult("", err)
+			continue
+		}
+
+		resp[macString] = newResult("removed", nil)
+	}
+
+	return resp, nil
+}
+
+func handleRateLimit(r *ratelimit.RateLimit, inv *device.Inventory, args []string, action string) (any, error) {
+	switch action {
+	case "set":
+		return handleRateLimitSet(r, inv, args)
+	case "list":
+		return handleRateLimitList(r, inv)
+	case "remove":
+		return handleRateLimitRemove(r, inv, args)
+	default:
+		return nil, invalidAction("ratelimit", action)
+	}
+}
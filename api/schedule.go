@@ -0,0 +1,117 @@
+package api
+
+import (
+	"github.com/cilium/cilium/pkg/mac"
+	"sinanmohd.com/redq/schedule"
+)
+
+type ScheduleStat struct {
+	Days    string   `json:"days"`
+	Start   string   `json:"start"`
+	Stop    string   `json:"stop"`
+	Macs    []string `json:"macs,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+	Active  bool     `json:"active"`
+}
+
+type ScheduleListResp map[string]ScheduleStat
+
+type ScheduleResp map[string]ItemResult
+
+// handleScheduleSet expects the arguments [name, days, start, stop,
+// targets...], days is like mon,tue or weekdays and start and stop
+// are like 23:00. every target is either a MAC address or a domain
+func handleScheduleSet(s *schedule.Schedule, args []string) (ScheduleResp, error) {
+	resp := make(ScheduleResp)
+
+	if len(args) < 5 {
+		return nil, invalidArgument("expected arguments [name, days, start, stop, targets...]")
+	}
+	name := args[0]
+
+	err := func() error {
+		var stat schedule.ScheduleStat
+		var err error
+
+		stat.Days, err = schedule.ParseDays(args[1])
+		if err != nil {
+			return err
+		}
+		stat.Start, err = schedule.ParseTime(args[2])
+		if err != nil {
+			return err
+		}
+		stat.Stop, err = schedule.ParseTime(args[3])
+		if err != nil {
+			return err
+		}
+
+		for _, target := range args[4:] {
+			hwAddr, err := parseMac(target)
+			if err != nil {
+				stat.Domains = append(stat.Domains, target)
+			} else {
+				stat.HardwareAddrs = append(stat.HardwareAddrs, hwAddr)
+			}
+		}
+
+		return s.Set(name, stat)
+	}()
+	if err != nil {
+		resp[name] = newResult("", err)
+	} else {
+		resp[name] = newResult("set", nil)
+	}
+
+	return resp, nil
+}
+
+func handleScheduleRemove(s *schedule.Schedule, names []string) (ScheduleResp, error) {
+	resp := make(ScheduleResp)
+
+	for _, name := range names {
+		err := s.Remove(name)
+		if err != nil {
+			resp[name] = newResult("", err)
+			continue
+		}
+
+		resp[name] = newResult("removed", nil)
+	}
+
+	return resp, nil
+}
+
+func handleScheduleList(s *schedule.Schedule) (ScheduleListResp, error) {
+	resp := make(ScheduleListResp)
+
+	for name, value := range s.List() {
+		stat := ScheduleStat{
+			Days:    schedule.FormatDays(value.Days),
+			Start:   schedule.FormatTime(value.Start),
+			Stop:    schedule.FormatTime(value.Stop),
+			Domains: value.Domains,
+			Active:  value.Active,
+		}
+		for _, hwAddr := range value.HardwareAddrs {
+			stat.Macs = append(stat.Macs, mac.Uint64MAC(hwAddr).String())
+		}
+
+		resp[name] = stat
+	}
+
+	return resp, nil
+}
+
+func handleSchedule(s *schedule.Schedule, args []string, action string) (any, error) {
+	switch action {
+	case "set":
+		return handleScheduleSet(s, args)
+	case "remove":
+		return handleScheduleRemove(s, args)
+	case "list":
+		return handleScheduleList(s)
+	default:
+		return nil, invalidAction("schedule", action)
+	}
+}
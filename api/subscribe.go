@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"sinanmohd.com/redq/device"
+	"sinanmohd.com/redq/event"
+)
+
+type SubscribeResp struct {
+	Events []string `json:"events"`
+}
+
+// EventStat is the data of an event other than bandwidth,
+// which carries a BandwidthResp instead
+type EventStat struct {
+	Time string `json:"time"`
+	Mac  string `json:"mac"`
+	DeviceInfo
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+var eventKinds = []event.Kind{
+	event.Bandwidth,
+	event.DeviceSeen,
+	event.Blocked,
+	event.Unblocked,
+	event.QuotaExceeded,
+}
+
+// parseKinds returns the events a subscriber asked for, all of them if none
+func parseKinds(args []string) (map[event.Kind]bool, error) {
+	kinds := make(map[event.Kind]bool)
+
+	if len(args) == 0 {
+		args = make([]string, len(eventKinds))
+		for i, kind := range eventKinds {
+			args[i] = string(kind)
+		}
+	}
+
+	for _, arg := range args {
+		kind := event.Kind(arg)
+		switch kind {
+		case event.Bandwidth, event.DeviceSeen, event.Blocked, event.Unblocked, event.QuotaExceeded:
+			kinds[kind] = true
+		default:
+			return nil, invalidArgument("invalid event '%s'", arg)
+		}
+	}
+
+	return kinds, nil
+}
+
+func eventData(e *event.Event, inv *device.Inventory) any {
+	if e.Kind == event.Bandwidth {
+		macs, total := sumBandwidth(e.Usage)
+		return newBandwidthResp(macs, total, inv)
+	}
+
+	stat := EventStat{
+		Time:       e.Time.Format(time.DateTime),
+		Mac:        mac.Uint64MAC(e.HardwareAddr).String(),
+		DeviceInfo: deviceInfo(inv, e.HardwareAddr),
+		Reason:     e.Reason,
+	}
+	if !e.ExpiresAt.IsZero() {
+		stat.ExpiresAt = e.ExpiresAt.Format(time.DateTime)
+	}
+
+	return stat
+}
+
+// subscribe takes over a connection and streams the events in the
+// arguments of req, or all of them, until the client hangs up. the
+// connection carries nothing else from then on. slow clients miss
+// events rather than piling them up, the next event they get tells
+// them how many were dropped
+func (a *Api) subscribe(conn net.Conn, reader *bufio.Reader, req *ApiReq, inv *device.Inventory, b *event.Bus) {
+	kinds, err := parseKinds(req.Arg)
+	if err != nil {
+		resp := newResp(req.Id, nil, err)
+		a.write(conn, &resp)
+		return
+	}
+
+	sub := b.Subscribe(kinds)
+	defer b.Unsubscribe(sub)
+
+	var ok SubscribeResp
+	for _, kind := range eventKinds {
+		if kinds[kind] {
+			ok.Events = append(ok.Events, string(kind))
+		}
+	}
+	resp := newResp(req.Id, ok, nil)
+	err = a.write(conn, &resp)
+	if err != nil {
+		return
+	}
+
+	// the client only has to keep the connection open, anything
+	// it sends is ignored and hanging up ends the subscription
+	hangup := make(chan struct{})
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(hangup)
+	}()
+
+	for {
+		select {
+		case <-hangup:
+			return
+		case e := <-sub.C:
+			resp := newResp(req.Id, eventData(&e, inv), nil)
+			resp.Event = string(e.Kind)
+			resp.Dropped = sub.Dropped()
+
+			err := a.write(conn, &resp)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
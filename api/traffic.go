@@ -0,0 +1,52 @@
+package api
+
+import (
+	"sinanmohd.com/redq/bpf/usage"
+)
+
+// TrafficStat splits a direction by address family and by transport protocol
+type TrafficStat struct {
+	IPv4  string `json:"ipv4"`
+	IPv6  string `json:"ipv6"`
+	Tcp   string `json:"tcp"`
+	Udp   string `json:"udp"`
+	Icmp  string `json:"icmp"`
+	Other string `json:"other"`
+}
+
+// traffic holds the per family and per protocol totals
+// of usage.Traffic, the database only stores those
+type traffic struct {
+	ipv4, ipv6, tcp, udp, icmp, other uint64
+}
+
+func newTraffic(t *usage.Traffic) traffic {
+	return traffic{
+		ipv4:  t.Family(usage.FamilyIPv4),
+		ipv6:  t.Family(usage.FamilyIPv6),
+		tcp:   t.Proto(usage.ProtoTcp),
+		udp:   t.Proto(usage.ProtoUdp),
+		icmp:  t.Proto(usage.ProtoIcmp),
+		other: t.Proto(usage.ProtoOther),
+	}
+}
+
+func (t *traffic) add(other traffic) {
+	t.ipv4 += other.ipv4
+	t.ipv6 += other.ipv6
+	t.tcp += other.tcp
+	t.udp += other.udp
+	t.icmp += other.icmp
+	t.other += other.other
+}
+
+func (t traffic) stat(format func(uint64) string) *TrafficStat {
+	return &TrafficStat{
+		IPv4:  format(t.ipv4),
+		IPv6:  format(t.ipv6),
+		Tcp:   format(t.tcp),
+		Udp:   format(t.udp),
+		Icmp:  format(t.icmp),
+		Other: format(t.other),
+	}
+}
@@ -2,47 +2,307 @@ package api
 
 import (
 	"context"
-	"encoding/json"
-	"log"
-	"net"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
 
+	"github.com/cilium/cilium/pkg/mac"
 	"github.com/dustin/go-humanize"
-	"sinanmohd.com/redq/db"
+	"github.com/jackc/pgx/v5/pgtype"
 	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/device"
 )
 
+// bucketLayout formats the start of a history bucket, the database
+// stores wall clock time so there's no time zone to report
+const bucketLayout = "2006-01-02T15:04:05"
+
 type UsageStat struct {
+	Ingress        string               `json:"ingress"`
+	Egress         string               `json:"egress"`
+	IngressPackets string               `json:"ingress_packets,omitempty"`
+	EgressPackets  string               `json:"egress_packets,omitempty"`
+	IngressDetail  *TrafficStat         `json:"ingress_detail,omitempty"`
+	EgressDetail   *TrafficStat         `json:"egress_detail,omitempty"`
+	Interfaces     map[string]UsageStat `json:"interfaces,omitempty"`
+}
+
+type UsageResp map[string]UsageStat
+
+type UsageHistoryStat struct {
+	Name    string `json:"name,omitempty"`
+	Time    string `json:"time"`
 	Ingress string `json:"ingress"`
 	Egress  string `json:"egress"`
 }
 
-type UsageResp map[string]UsageStat
+type UsageHistoryResp map[string][]UsageHistoryStat
 
-func handleUsage(conn net.Conn, u *usage.Usage, queries *db.Queries, ctxDb context.Context) {
+// ifaceUsage is the usage of an interface, stored or not
+type ifaceUsage struct {
+	ingress, egress               uint64
+	ingressPackets, egressPackets uint64
+	ingressTraffic, egressTraffic traffic
+}
+
+func (i *ifaceUsage) add(other *ifaceUsage) {
+	i.ingress += other.ingress
+	i.egress += other.egress
+	i.ingressPackets += other.ingressPackets
+	i.egressPackets += other.egressPackets
+	i.ingressTraffic.add(other.ingressTraffic)
+	i.egressTraffic.add(other.egressTraffic)
+}
+
+func (i *ifaceUsage) stat() UsageStat {
+	return UsageStat{
+		Ingress:        humanize.Bytes(i.ingress),
+		Egress:         humanize.Bytes(i.egress),
+		IngressPackets: humanize.Comma(int64(i.ingressPackets)),
+		EgressPackets:  humanize.Comma(int64(i.egressPackets)),
+		IngressDetail:  i.ingressTraffic.stat(humanize.Bytes),
+		EgressDetail:   i.egressTraffic.stat(humanize.Bytes),
+	}
+}
+
+func handleUsageTotal(u *usage.Usage, queries *db.Queries, ctxDb context.Context) (UsageResp, error) {
 	resp := make(UsageResp)
+	ifaces := make(map[string]*ifaceUsage)
+	var total ifaceUsage
 
-	fetchedUsage, err := queries.GetUsage(ctxDb)
+	fetchedUsage, err := queries.GetUsageByIface(ctxDb)
 	if err != nil {
-		log.Printf("fetching from database: %s", err)
-		return
+		return nil, internalError("fetching from database", err)
+	}
+	for _, row := range fetchedUsage {
+		ifaces[row.Iface] = &ifaceUsage{
+			ingress:        uint64(row.Ingress),
+			egress:         uint64(row.Egress),
+			ingressPackets: uint64(row.Ingresspackets),
+			egressPackets:  uint64(row.Egresspackets),
+			ingressTraffic: traffic{
+				ipv4:  uint64(row.Ingressipv4),
+				ipv6:  uint64(row.Ingressipv6),
+				tcp:   uint64(row.Ingresstcp),
+				udp:   uint64(row.Ingressudp),
+				icmp:  uint64(row.Ingressicmp),
+				other: uint64(row.Ingressother),
+			},
+			egressTraffic: traffic{
+				ipv4:  uint64(row.Egressipv4),
+				ipv6:  uint64(row.Egressipv6),
+				tcp:   uint64(row.Egresstcp),
+				udp:   uint64(row.Egressudp),
+				icmp:  uint64(row.Egressicmp),
+				other: uint64(row.Egressother),
+			},
+		}
 	}
 
 	u.Mutex.RLock()
-	for _, value := range u.Data {
-		fetchedUsage.Ingress += int64(value.Ingress)
-		fetchedUsage.Egress += int64(value.Egress)
+	for key, value := range u.Data {
+		iface, ok := ifaces[key.Iface]
+		if !ok {
+			iface = &ifaceUsage{}
+			ifaces[key.Iface] = iface
+		}
+
+		iface.add(&ifaceUsage{
+			ingress:        value.Ingress,
+			egress:         value.Egress,
+			ingressPackets: value.IngressPackets,
+			egressPackets:  value.EgressPackets,
+			ingressTraffic: newTraffic(&value.IngressTraffic),
+			egressTraffic:  newTraffic(&value.EgressTraffic),
+		})
 	}
 	u.Mutex.RUnlock()
-	resp["total"] = UsageStat{
-		Ingress: humanize.Bytes(uint64(fetchedUsage.Ingress)),
-		Egress:  humanize.Bytes(uint64(fetchedUsage.Egress)),
+
+	stats := make(map[string]UsageStat)
+	for name, iface := range ifaces {
+		total.add(iface)
+		stats[name] = iface.stat()
+	}
+	totalStat := total.stat()
+	totalStat.Interfaces = stats
+	resp["total"] = totalStat
+
+	return resp, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	t, err := time.ParseInLocation(time.RFC3339, value, time.Local)
+	if err == nil {
+		return t.In(time.Local), nil
+	}
+
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
+func truncateTime(t time.Time, period string) time.Time {
+	switch period {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// parseUsageRange parses the [from, to, period] arguments of a usage
+// history request, period is optional and defaults to the whole range
+func parseUsageRange(args []string) (from, to time.Time, period string, err error) {
+	if len(args) < 2 || len(args) > 3 {
+		err = errors.New("expected arguments [from, to, period]")
+		return
 	}
 
-	buf, err := json.Marshal(resp)
+	from, err = parseTime(args[0])
 	if err != nil {
-		log.Printf("marshaling json: %s", err)
 		return
 	}
+	to, err = parseTime(args[1])
+	if err != nil {
+		return
+	}
+	if !from.Before(to) {
+		err = errors.New("from must be before to")
+		return
+	}
+
+	if len(args) == 3 {
+		period = args[2]
+		switch period {
+		case "hour", "day", "month":
+		default:
+			err = fmt.Errorf("invalid period '%s'", period)
+		}
+	}
+
+	return
+}
+
+func handleUsageHistory(u *usage.Usage, inv *device.Inventory, queries *db.Queries, ctxDb context.Context, args []string) (UsageHistoryResp, error) {
+	from, to, period, err := parseUsageRange(args)
+	if err != nil {
+		return nil, invalidArgument("%s", err)
+	}
+
+	buckets := make(map[uint64]map[string]*db.GetUsageHistoryRow)
+	var order []string
+	seen := make(map[string]bool)
+	addBucket := func(row db.GetUsageHistoryRow, bucket string) {
+		key := uint64(row.Hardwareaddr)
+		macBuckets, ok := buckets[key]
+		if !ok {
+			macBuckets = make(map[string]*db.GetUsageHistoryRow)
+			buckets[key] = macBuckets
+		}
+
+		b, ok := macBuckets[bucket]
+		if !ok {
+			b = &db.GetUsageHistoryRow{Hardwareaddr: row.Hardwareaddr}
+			macBuckets[bucket] = b
+		}
+		b.Ingress += row.Ingress
+		b.Egress += row.Egress
+
+		if !seen[bucket] {
+			seen[bucket] = true
+			order = append(order, bucket)
+		}
+	}
+
+	startTime := pgtype.Timestamp{Time: from, Valid: true}
+	stopTime := pgtype.Timestamp{Time: to, Valid: true}
+	if period == "" {
+		rows, err := queries.GetUsageByMac(ctxDb, db.GetUsageByMacParams{
+			StartTime: startTime,
+			StopTime:  stopTime,
+		})
+		if err != nil {
+			return nil, internalError("fetching from database", err)
+		}
 
-	conn.Write(buf)
+		for _, row := range rows {
+			addBucket(db.GetUsageHistoryRow{
+				Hardwareaddr: row.Hardwareaddr,
+				Ingress:      row.Ingress,
+				Egress:       row.Egress,
+			}, from.Format(bucketLayout))
+		}
+	} else {
+		rows, err := queries.GetUsageHistory(ctxDb, db.GetUsageHistoryParams{
+			Period:    period,
+			StartTime: startTime,
+			StopTime:  stopTime,
+		})
+		if err != nil {
+			return nil, internalError("fetching from database", err)
+		}
+
+		for _, row := range rows {
+			addBucket(row, row.Bucket.Time.Format(bucketLayout))
+		}
+	}
+
+	// traffic that hasn't been pushed to the database yet
+	u.Mutex.RLock()
+	for key, value := range u.Data {
+		since, lastSeen := value.Since(), value.LastSeen()
+		if lastSeen.Before(from) || !since.Before(to) {
+			continue
+		}
+
+		bucket := from.Format(bucketLayout)
+		if period != "" {
+			bucket = truncateTime(since, period).Format(bucketLayout)
+		}
+		addBucket(db.GetUsageHistoryRow{
+			Hardwareaddr: int64(key.HardwareAddr),
+			Ingress:      int64(value.Ingress),
+			Egress:       int64(value.Egress),
+		}, bucket)
+	}
+	u.Mutex.RUnlock()
+
+	// the layout sorts lexically in chronological order
+	sort.Strings(order)
+	resp := make(UsageHistoryResp)
+	for key, macBuckets := range buckets {
+		var stats []UsageHistoryStat
+		name := inv.Name(key)
+		for _, bucket := range order {
+			b, ok := macBuckets[bucket]
+			if !ok {
+				continue
+			}
+
+			stats = append(stats, UsageHistoryStat{
+				Name:    name,
+				Time:    bucket,
+				Ingress: humanize.Bytes(uint64(b.Ingress)),
+				Egress:  humanize.Bytes(uint64(b.Egress)),
+			})
+		}
+
+		m := mac.Uint64MAC(key)
+		resp[m.String()] = stats
+	}
+
+	return resp, nil
+}
+
+func handleUsage(u *usage.Usage, inv *device.Inventory, queries *db.Queries, ctxDb context.Context, args []string, action string) (any, error) {
+	switch action {
+	case "", "total":
+		return handleUsageTotal(u, queries, ctxDb)
+	case "history":
+		return handleUsageHistory(u, inv, queries, ctxDb, args)
+	default:
+		return nil, invalidAction("usage", action)
+	}
 }
@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"sinanmohd.com/redq/db"
+)
+
+// stores whether the filter runs in allowlist mode
+const allowlistSetting = "filter.allowlist"
+
+// loadAllowList fills the allow map and restores the mode,
+// the caller must hold the mutex
+func (f *Filter) loadAllowList() error {
+	allowList, err := f.queries.GetMacAllowList(f.ctxDb)
+	if err != nil {
+		return err
+	}
+	for _, hwAddr := range allowList {
+		mac := uint64(hwAddr)
+		err = f.objs.bpfMaps.MacAllowlistMap.Put(mac, uint16(0))
+		if err != nil {
+			return err
+		}
+		f.allowed[mac] = true
+	}
+
+	value, err := f.queries.GetSetting(f.ctxDb, allowlistSetting)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+
+	return f.setMode(enabled)
+}
+
+// setMode switches the mode of every interface at once, the
+// program has a single switch shared by all of them
+func (f *Filter) setMode(allowlist bool) error {
+	var value uint32
+
+	if allowlist {
+		value = 1
+		if len(f.ifaces) > 1 {
+			log.Printf("allowlist mode applies to every filtered interface: %s", strings.Join(f.ifaces, ", "))
+		}
+	}
+
+	return f.objs.bpfMaps.FilterConfigMap.Put(uint32(bpfFilterConfigFILTER_CONFIG_ALLOWLIST), value)
+}
+
+// SetAllowlist switches between dropping only blocked devices and
+// dropping every device that isn't allowed, blocks apply either way.
+// the mode is global, unknown devices are dropped on every interface
+func (f *Filter) SetAllowlist(enabled bool) error {
+	f.mutex.Lock()
+	empty := len(f.allowed) == 0
+	f.mutex.Unlock()
+	// with nothing allowed every device would be cut off, including
+	// the one switching the mode
+	if enabled && empty {
+		return errors.New("allowlist is empty, allow a device first")
+	}
+
+	err := f.queries.EnterSetting(f.ctxDb, db.EnterSettingParams{
+		Name:  allowlistSetting,
+		Value: strconv.FormatBool(enabled),
+	})
+	if err != nil {
+		log.Printf("setting filter mode: %s", err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err = f.setMode(enabled)
+	if err != nil {
+		log.Printf("setting filter mode: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Interfaces returns the interfaces the filter and its mode apply to
+func (f *Filter) Interfaces() []string {
+	return slices.Clone(f.ifaces)
+}
+
+func (f *Filter) Allowlist() bool {
+	var value uint32
+
+	err := f.objs.bpfMaps.FilterConfigMap.Lookup(uint32(bpfFilterConfigFILTER_CONFIG_ALLOWLIST), &value)
+	return err == nil && value != 0
+}
+
+// Allow lets a device through in allowlist mode
+func (f *Filter) Allow(mac uint64) error {
+	err := f.queries.EnterMacAllowList(f.ctxDb, int64(mac))
+	if err != nil {
+		log.Printf("adding mac allowlist: %s", err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err = f.objs.bpfMaps.MacAllowlistMap.Put(mac, uint16(0))
+	if err != nil {
+		log.Printf("adding mac allowlist: %s", err)
+		return err
+	}
+	f.allowed[mac] = true
+
+	return nil
+}
+
+func (f *Filter) Disallow(mac uint64) error {
+	err := f.queries.DeleteMacAllowList(f.ctxDb, int64(mac))
+	if err != nil {
+		log.Printf("deleting mac allowlist: %s", err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.allowed[mac] {
+		return nil
+	}
+	err = f.objs.bpfMaps.MacAllowlistMap.Delete(mac)
+	if err != nil {
+		log.Printf("deleting mac allowlist: %s", err)
+		return err
+	}
+	delete(f.allowed, mac)
+
+	return nil
+}
+
+func (f *Filter) Allowed() []uint64 {
+	var macs []uint64
+
+	f.mutex.Lock()
+	for mac := range f.allowed {
+		macs = append(macs, mac)
+	}
+	f.mutex.Unlock()
+
+	sort.Slice(macs, func(i, j int) bool {
+		return macs[i] < macs[j]
+	})
+	return macs
+}
@@ -1,6 +1,7 @@
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 
 #include <bpf/bpf_endian.h>
 #include <bpf/bpf_helpers.h>
@@ -18,31 +19,60 @@ struct {
 	__type(value, __u16); 
 } mac_blacklist_map SEC(".maps");
 
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__type(key, __u64);  // allowed mac address
+	__type(value, __u16);
+} mac_allowlist_map SEC(".maps");
+
+enum filter_config {
+	// non zero to drop every device missing from mac_allowlist_map,
+	// there's one switch for every interface the filter is attached to
+	FILTER_CONFIG_ALLOWLIST,
+	FILTER_CONFIG_MAX,
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, FILTER_CONFIG_MAX);
+	__type(key, enum filter_config);
+	__type(value, __u32);
+} filter_config_map SEC(".maps");
+
+struct ipv4_lpm_key {
+	__u32 prefixlen;
+	__u8 addr[4];
+};
+
+struct ipv6_lpm_key {
+	__u32 prefixlen;
+	__u8 addr[16];
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct ipv4_lpm_key); // blocked prefix
+	__type(value, __u16);
+} ipv4_blacklist_map SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct ipv6_lpm_key); // blocked prefix
+	__type(value, __u16);
+} ipv6_blacklist_map SEC(".maps");
+
 static __always_inline __u64 nchar6_to_u64(unsigned char bytes[6])
 {
-	union {
-		char bytes[6];
-		__u64 i;
-	} ret;
-
-	ret.i = 0;
-#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
-	ret.bytes[0] = bytes[5];
-	ret.bytes[1] = bytes[4];
-	ret.bytes[2] = bytes[3];
-	ret.bytes[3] = bytes[2];
-	ret.bytes[4] = bytes[1];
-	ret.bytes[5] = bytes[0];
-#elif __BYTE_ORDER__ == __ORDER_BIG_ENDIAN__
-	ret.bytes[0] = bytes[0];
-	ret.bytes[1] = bytes[1];
-	ret.bytes[2] = bytes[2];
-	ret.bytes[3] = bytes[3];
-	ret.bytes[4] = bytes[4];
-	ret.bytes[5] = bytes[5];
-#endif
-
-	return ret.i;
+	// the layout of cilium's mac.Uint64, the first octet is the
+	// least significant byte so keys match the MACs userspace parses
+	return (__u64) bytes[0] | (__u64) bytes[1] << 8 |
+	       (__u64) bytes[2] << 16 | (__u64) bytes[3] << 24 |
+	       (__u64) bytes[4] << 32 | (__u64) bytes[5] << 40;
 }
 
 static __always_inline int mac_src_parse(struct xdp_md *ctx, __u64 *mac)
@@ -64,10 +94,53 @@ static __always_inline int mac_src_parse(struct xdp_md *ctx, __u64 *mac)
 	return 0;
 }
 
+/* matches the source and destination addresses against the prefix maps */
+static __always_inline int ip_blocked(struct xdp_md *ctx)
+{
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = (void *)(long)ctx->data;
+
+	if ((void *) (eth + 1) > data_end)
+		return 0;
+
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *) (eth + 1);
+		struct ipv4_lpm_key key = { .prefixlen = 32 };
+
+		if ((void *) (ip + 1) > data_end)
+			return 0;
+
+		__builtin_memcpy(key.addr, &ip->saddr, sizeof(key.addr));
+		if (bpf_map_lookup_elem(&ipv4_blacklist_map, &key))
+			return 1;
+
+		__builtin_memcpy(key.addr, &ip->daddr, sizeof(key.addr));
+		if (bpf_map_lookup_elem(&ipv4_blacklist_map, &key))
+			return 1;
+	} else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip6 = (void *) (eth + 1);
+		struct ipv6_lpm_key key = { .prefixlen = 128 };
+
+		if ((void *) (ip6 + 1) > data_end)
+			return 0;
+
+		__builtin_memcpy(key.addr, &ip6->saddr, sizeof(key.addr));
+		if (bpf_map_lookup_elem(&ipv6_blacklist_map, &key))
+			return 1;
+
+		__builtin_memcpy(key.addr, &ip6->daddr, sizeof(key.addr));
+		if (bpf_map_lookup_elem(&ipv6_blacklist_map, &key))
+			return 1;
+	}
+
+	return 0;
+}
+
 SEC("xdp")
 int mac_filter(struct xdp_md *ctx)
 {
 	__u64 mac;
+	__u32 key, *allowlist;
 	int ret, *blocked;
 
 	ret = mac_src_parse(ctx, &mac);
@@ -78,5 +151,14 @@ int mac_filter(struct xdp_md *ctx)
 	if (blocked)
 		return XDP_DROP;
 
+	key = FILTER_CONFIG_ALLOWLIST;
+	allowlist = bpf_map_lookup_elem(&filter_config_map, &key);
+	if (allowlist && *allowlist &&
+	    !bpf_map_lookup_elem(&mac_allowlist_map, &mac))
+		return XDP_DROP;
+
+	if (ip_blocked(ctx))
+		return XDP_DROP;
+
 	return XDP_PASS;
 }
@@ -12,6 +12,23 @@ import (
 	"github.com/cilium/ebpf"
 )
 
+type bpfFilterConfig uint32
+
+const (
+	bpfFilterConfigFILTER_CONFIG_ALLOWLIST bpfFilterConfig = 0
+	bpfFilterConfigFILTER_CONFIG_MAX       bpfFilterConfig = 1
+)
+
+type bpfIpv4LpmKey struct {
+	Prefixlen uint32
+	Addr      [4]uint8
+}
+
+type bpfIpv6LpmKey struct {
+	Prefixlen uint32
+	Addr      [16]uint8
+}
+
 // loadBpf returns the embedded CollectionSpec for bpf.
 func loadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -60,7 +77,11 @@ type bpfProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	MacBlacklistMap *ebpf.MapSpec `ebpf:"mac_blacklist_map"`
+	FilterConfigMap  *ebpf.MapSpec `ebpf:"filter_config_map"`
+	Ipv4BlacklistMap *ebpf.MapSpec `ebpf:"ipv4_blacklist_map"`
+	Ipv6BlacklistMap *ebpf.MapSpec `ebpf:"ipv6_blacklist_map"`
+	MacAllowlistMap  *ebpf.MapSpec `ebpf:"mac_allowlist_map"`
+	MacBlacklistMap  *ebpf.MapSpec `ebpf:"mac_blacklist_map"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -82,11 +103,19 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	MacBlacklistMap *ebpf.Map `ebpf:"mac_blacklist_map"`
+	FilterConfigMap  *ebpf.Map `ebpf:"filter_config_map"`
+	Ipv4BlacklistMap *ebpf.Map `ebpf:"ipv4_blacklist_map"`
+	Ipv6BlacklistMap *ebpf.Map `ebpf:"ipv6_blacklist_map"`
+	MacAllowlistMap  *ebpf.Map `ebpf:"mac_allowlist_map"`
+	MacBlacklistMap  *ebpf.Map `ebpf:"mac_blacklist_map"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
+		m.FilterConfigMap,
+		m.Ipv4BlacklistMap,
+		m.Ipv6BlacklistMap,
+		m.MacAllowlistMap,
 		m.MacBlacklistMap,
 	)
 }
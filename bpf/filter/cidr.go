@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"errors"
+	"log"
+	"net/netip"
+	"sort"
+)
+
+// normalizePrefix masks the host bits off a prefix, so
+// 10.0.0.1/8 and 10.0.0.0/8 are the same block
+func normalizePrefix(prefix netip.Prefix) (netip.Prefix, error) {
+	if !prefix.IsValid() {
+		return netip.Prefix{}, errors.New("invalid cidr prefix")
+	}
+
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits = max(bits-96, 0)
+	}
+
+	return netip.PrefixFrom(addr, bits).Masked(), nil
+}
+
+// putPrefix adds a prefix to the map of its address family
+func (f *Filter) putPrefix(prefix netip.Prefix) error {
+	if prefix.Addr().Is4() {
+		key := bpfIpv4LpmKey{
+			Prefixlen: uint32(prefix.Bits()),
+			Addr:      prefix.Addr().As4(),
+		}
+		return f.objs.bpfMaps.Ipv4BlacklistMap.Put(key, uint16(0))
+	}
+
+	key := bpfIpv6LpmKey{
+		Prefixlen: uint32(prefix.Bits()),
+		Addr:      prefix.Addr().As16(),
+	}
+	return f.objs.bpfMaps.Ipv6BlacklistMap.Put(key, uint16(0))
+}
+
+func (f *Filter) deletePrefix(prefix netip.Prefix) error {
+	if prefix.Addr().Is4() {
+		key := bpfIpv4LpmKey{
+			Prefixlen: uint32(prefix.Bits()),
+			Addr:      prefix.Addr().As4(),
+		}
+		return f.objs.bpfMaps.Ipv4BlacklistMap.Delete(key)
+	}
+
+	key := bpfIpv6LpmKey{
+		Prefixlen: uint32(prefix.Bits()),
+		Addr:      prefix.Addr().As16(),
+	}
+	return f.objs.bpfMaps.Ipv6BlacklistMap.Delete(key)
+}
+
+// BlockCIDR drops traffic from or to every address in prefix,
+// regardless of the device sending it
+func (f *Filter) BlockCIDR(prefix netip.Prefix) error {
+	prefix, err := normalizePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	err = f.queries.EnterCidrBlackList(f.ctxDb, prefix)
+	if err != nil {
+		log.Printf("adding cidr blacklist: %s", err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err = f.putPrefix(prefix)
+	if err != nil {
+		log.Printf("adding cidr blacklist: %s", err)
+		return err
+	}
+	f.cidrs[prefix] = true
+
+	return nil
+}
+
+// UnblockCIDR lifts a block made with BlockCIDR, addresses
+// also covered by other blocked prefixes stay blocked
+func (f *Filter) UnblockCIDR(prefix netip.Prefix) error {
+	prefix, err := normalizePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	err = f.queries.DeleteCidrBlackList(f.ctxDb, prefix)
+	if err != nil {
+		log.Printf("deleting cidr blacklist: %s", err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.cidrs[prefix] {
+		return nil
+	}
+	err = f.deletePrefix(prefix)
+	if err != nil {
+		log.Printf("deleting cidr blacklist: %s", err)
+		return err
+	}
+	delete(f.cidrs, prefix)
+
+	return nil
+}
+
+func (f *Filter) BlockedCIDRs() []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	f.mutex.Lock()
+	for prefix := range f.cidrs {
+		prefixes = append(prefixes, prefix)
+	}
+	f.mutex.Unlock()
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].String() < prefixes[j].String()
+	})
+	return prefixes
+}
@@ -2,27 +2,49 @@ package filter
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"sinanmohd.com/redq/config"
 	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/event"
 )
 
 type Filter struct {
-	ctxDb context.Context
-	queries *db.Queries
-	objs bpfObjects
-	xdpLink link.Link
+	ctxDb    context.Context
+	queries  *db.Queries
+	bus      *event.Bus
+	objs     bpfObjects
+	xdpLinks []link.Link
+	// the interfaces the filter is attached to
+	ifaces []string
+	mutex  sync.Mutex
+	// devices blocked with Block, stored in the database
+	blocked map[uint64]bool
+	// when the blocks that expire are lifted
+	expires map[uint64]time.Time
+	// devices blocked for as long as something holds them, by reason
+	holds map[uint64]map[string]bool
+	// prefixes blocked with BlockCIDR
+	cidrs map[netip.Prefix]bool
+	// devices let through in allowlist mode
+	allowed map[uint64]bool
 }
 
 func Close(f *Filter) {
 	f.objs.Close()
-	f.xdpLink.Close()
+	for _, xdpLink := range f.xdpLinks {
+		xdpLink.Close()
+	}
 }
 
-func New(iface *net.Interface, queries *db.Queries, ctxDb context.Context) (*Filter, error) {
+func New(cfg *config.Config, b *event.Bus, queries *db.Queries, ctxDb context.Context) (*Filter, error) {
 	var err error
 	var f Filter
 
@@ -35,61 +57,268 @@ func New(iface *net.Interface, queries *db.Queries, ctxDb context.Context) (*Fil
 			f.objs.Close()
 		}
 	}()
-
-	f.xdpLink, err = link.AttachXDP(link.XDPOptions{
-		Interface: iface.Index,
-		Program:   f.objs.MacFilter,
-	})
-	if err != nil {
-		log.Printf("could not attach TCx program: %s", err)
-		return nil, err
-	}
 	defer func() {
 		if err != nil {
-			f.xdpLink.Close()
+			for _, xdpLink := range f.xdpLinks {
+				xdpLink.Close()
+			}
 		}
 	}()
+	for _, name := range cfg.Interfaces {
+		var iface *net.Interface
+		var xdpLink link.Link
+
+		iface, err = net.InterfaceByName(name)
+		if err != nil {
+			log.Printf("lookup network: %s", err)
+			return nil, err
+		}
+
+		xdpLink, err = link.AttachXDP(link.XDPOptions{
+			Interface: iface.Index,
+			Program:   f.objs.MacFilter,
+		})
+		if err != nil {
+			log.Printf("could not attach XDP program to %s: %s", name, err)
+			return nil, err
+		}
+		f.xdpLinks = append(f.xdpLinks, xdpLink)
+	}
+	f.ifaces = cfg.Interfaces
 
 	blackList, err := queries.GetMacBlackList(ctxDb)
+	if err != nil {
+		log.Printf("reading mac blacklist: %s", err)
+		return nil, err
+	}
+	macs := make([]uint64, len(blackList))
+	for i, entry := range blackList {
+		macs[i] = uint64(entry.Hardwareaddr)
+	}
 	zeros := make([]uint16, len(blackList))
-	_, err = f.objs.bpfMaps.MacBlacklistMap.BatchUpdate(blackList[:], zeros, nil)
+	_, err = f.objs.bpfMaps.MacBlacklistMap.BatchUpdate(macs, zeros, nil)
 	if err != nil {
 		log.Printf("loading mac blacklist: %s", err)
 		return nil, err
 	}
 
 	f.queries = queries
+	f.ctxDb = ctxDb
+	f.bus = b
+	f.blocked = make(map[uint64]bool)
+	f.expires = make(map[uint64]time.Time)
+	f.holds = make(map[uint64]map[string]bool)
+	f.cidrs = make(map[netip.Prefix]bool)
+	f.allowed = make(map[uint64]bool)
+
+	cidrBlackList, err := queries.GetCidrBlackList(ctxDb)
+	if err != nil {
+		log.Printf("reading cidr blacklist: %s", err)
+		return nil, err
+	}
+	for _, prefix := range cidrBlackList {
+		err = f.putPrefix(prefix)
+		if err != nil {
+			log.Printf("loading cidr blacklist: %s", err)
+			return nil, err
+		}
+		f.cidrs[prefix] = true
+	}
+
+	f.mutex.Lock()
+	err = f.loadAllowList()
+	if err != nil {
+		f.mutex.Unlock()
+		log.Printf("loading mac allowlist: %s", err)
+		return nil, err
+	}
+	for _, entry := range blackList {
+		mac := uint64(entry.Hardwareaddr)
+		f.blocked[mac] = true
+		// blocks that expired while we were down are lifted right away
+		f.expireAt(mac, db.LocalTime(entry.Expiresat))
+	}
+	f.mutex.Unlock()
 	return &f, nil
 }
 
-func (f *Filter) Block(mac uint64) error {
-	err := f.queries.EnterMacBlackList(f.ctxDb, int64(mac))
+// expireAt arranges for a block to be lifted at expiresAt, replacing
+// the previous expiry. the caller must hold the mutex
+func (f *Filter) expireAt(mac uint64, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(f.expires, mac)
+		return
+	}
+
+	f.expires[mac] = expiresAt
+	time.AfterFunc(time.Until(expiresAt), func() {
+		f.expire(mac, expiresAt)
+	})
+}
+
+func (f *Filter) expire(mac uint64, expiresAt time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// the block was replaced or lifted in the meantime
+	if !f.expires[mac].Equal(expiresAt) {
+		return
+	}
+
+	err := f.queries.DeleteMacBlackList(f.ctxDb, int64(mac))
+	if err != nil {
+		log.Printf("deleting expired mac blacklist: %s", err)
+		return
+	}
+
+	delete(f.blocked, mac)
+	delete(f.expires, mac)
+	err = f.sync(mac)
+	if err != nil {
+		log.Printf("deleting expired mac blacklist: %s", err)
+		return
+	}
+
+	f.bus.Publish(event.Event{
+		Kind:         event.Unblocked,
+		HardwareAddr: mac,
+		Reason:       "expired",
+	})
+}
+
+// sync puts a device in the bpf map if it's blocked or held,
+// and removes it otherwise. the caller must hold the mutex
+func (f *Filter) sync(mac uint64) error {
+	if f.blocked[mac] || len(f.holds[mac]) > 0 {
+		return f.objs.bpfMaps.MacBlacklistMap.Put(mac, uint16(0))
+	}
+
+	// the device may already be gone, unblocking it twice is fine
+	err := f.objs.bpfMaps.MacBlacklistMap.Delete(mac)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Block blocks a device until expiresAt, or until
+// it's unblocked if expiresAt is zero
+func (f *Filter) Block(mac uint64, expiresAt time.Time) error {
+	err := f.queries.EnterMacBlackList(f.ctxDb, db.EnterMacBlackListParams{
+		Hardwareaddr: int64(mac),
+		Expiresat:    db.Timestamp(expiresAt),
+	})
 	if err != nil {
 		log.Printf("adding mac blacklist: %s", err)
 		return err
 	}
 
-	err = f.objs.bpfMaps.MacBlacklistMap.Put(mac, true)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.blocked[mac] = true
+	f.expireAt(mac, expiresAt)
+	err = f.sync(mac)
 	if err != nil {
 		log.Printf("adding mac blacklist: %s", err)
 		return err
 	}
 
+	f.bus.Publish(event.Event{
+		Kind:         event.Blocked,
+		HardwareAddr: mac,
+		ExpiresAt:    expiresAt,
+	})
 	return nil
 }
 
+// Unblock lifts a block made with Block,
+// devices still held stay blocked
 func (f *Filter) Unblock(mac uint64) error {
-	err := f.queries.DeleteDnsBlackList(f.ctxDb, fmt.Sprintf("%v", mac))
+	err := f.queries.DeleteMacBlackList(f.ctxDb, int64(mac))
 	if err != nil {
-		log.Printf("adding mac blacklist: %s", err)
+		log.Printf("deleting mac blacklist: %s", err)
 		return err
 	}
 
-	err = f.objs.bpfMaps.MacBlacklistMap.Delete(mac)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.blocked, mac)
+	f.expireAt(mac, time.Time{})
+	err = f.sync(mac)
 	if err != nil {
-		log.Printf("adding mac blacklist: %s", err)
+		log.Printf("deleting mac blacklist: %s", err)
+		return err
+	}
+
+	f.bus.Publish(event.Event{
+		Kind:         event.Unblocked,
+		HardwareAddr: mac,
+	})
+	return nil
+}
+
+// Hold blocks a device until every reason holding it is released,
+// holds aren't stored so their owners must hold again after a restart
+func (f *Filter) Hold(mac uint64, reason string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	reasons, ok := f.holds[mac]
+	if !ok {
+		reasons = make(map[string]bool)
+		f.holds[mac] = reasons
+	}
+	held := reasons[reason]
+	reasons[reason] = true
+
+	err := f.sync(mac)
+	if err != nil {
+		log.Printf("holding mac: %s", err)
 		return err
 	}
 
+	if !held {
+		f.bus.Publish(event.Event{
+			Kind:         event.Blocked,
+			HardwareAddr: mac,
+			Reason:       reason,
+		})
+	}
 	return nil
 }
+
+func (f *Filter) Release(mac uint64, reason string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.holds[mac][reason] {
+		return nil
+	}
+	delete(f.holds[mac], reason)
+	if len(f.holds[mac]) == 0 {
+		delete(f.holds, mac)
+	}
+
+	err := f.sync(mac)
+	if err != nil {
+		log.Printf("releasing mac: %s", err)
+		return err
+	}
+
+	f.bus.Publish(event.Event{
+		Kind:         event.Unblocked,
+		HardwareAddr: mac,
+		Reason:       reason,
+	})
+	return nil
+}
+
+func (f *Filter) IsBlocked(mac uint64) bool {
+	var value uint16
+
+	err := f.objs.bpfMaps.MacBlacklistMap.Lookup(mac, &value)
+	return err == nil
+}
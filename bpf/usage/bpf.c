@@ -1,27 +1,131 @@
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
+#include <linux/in.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 
 #include <bpf/bpf_endian.h>
 #include <bpf/bpf_helpers.h>
 
 #define MAX_MAP_ENTRIES 4096
+#define MAX_FLOW_ENTRIES 65536
+#define NSEC_PER_SEC 1000000000ULL
+// smallest bucket, so rates below the size of a GSO packet still pass traffic
+#define MIN_BURST (64 * 1024)
 
 char __license[] SEC("license") = "GPL";
 
+enum usage_family {
+	USAGE_FAMILY_IPV4,
+	USAGE_FAMILY_IPV6,
+	USAGE_FAMILY_MAX,
+};
+
+enum usage_proto {
+	USAGE_PROTO_TCP,
+	USAGE_PROTO_UDP,
+	USAGE_PROTO_ICMP,
+	USAGE_PROTO_OTHER,
+	USAGE_PROTO_MAX,
+};
+
+struct usage {
+	__u64 bytes[USAGE_FAMILY_MAX][USAGE_PROTO_MAX];
+	__u64 packets;
+};
+
 struct {
 	__uint(type, BPF_MAP_TYPE_LRU_HASH);
 	__uint(max_entries, MAX_MAP_ENTRIES);
-	__type(key, __u64);   // source mac address
-	__type(value, __u64); // no of bytes
-} ingress_ip4_usage_map SEC(".maps");
+	__type(key, __u64); // source mac address
+	__type(value, struct usage);
+} ingress_usage_map SEC(".maps");
 
 struct {
 	__uint(type, BPF_MAP_TYPE_LRU_HASH);
 	__uint(max_entries, MAX_MAP_ENTRIES);
-	__type(key, __u64);   // destination mac address
-	__type(value, __u64); // no of bytes
-} egress_ip4_usage_map SEC(".maps");
+	__type(key, __u64); // destination mac address
+	__type(value, struct usage);
+} egress_usage_map SEC(".maps");
+
+struct rate_limit {
+	__u64 ingress; // bytes per second, zero for no limit
+	__u64 egress;
+};
+
+struct token_bucket {
+	// packets of a device are handled on several cpus at once
+	struct bpf_spin_lock lock;
+	__u64 tokens; // bytes that may pass right away
+	__u64 last;   // time of the last refill in nanoseconds
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__type(key, __u64); // mac address
+	__type(value, struct rate_limit);
+} rate_limit_map SEC(".maps");
+
+// every interface loads its own maps, so a device has a bucket per
+// interface and its limit applies to each of them separately. spin
+// locks aren't allowed in LRU maps, userspace deletes the bucket of a
+// device along with its limit
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__type(key, __u64); // source mac address
+	__type(value, struct token_bucket);
+} ingress_bucket_map SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_MAP_ENTRIES);
+	__type(key, __u64); // destination mac address
+	__type(value, struct token_bucket);
+} egress_bucket_map SEC(".maps");
+
+enum usage_config {
+	// non zero to account traffic per flow in flow_map
+	USAGE_CONFIG_FLOWS,
+	USAGE_CONFIG_MAX,
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, USAGE_CONFIG_MAX);
+	__type(key, enum usage_config);
+	__type(value, __u32);
+} usage_config_map SEC(".maps");
+
+/*
+ * flows are seen from the device, so both directions of a
+ * connection end up in the same entry
+ */
+struct flow_key {
+	__u64 mac;
+	__u8 local[16]; // IPv4 addresses use the first 4 bytes
+	__u8 remote[16];
+	__u16 local_port; // zero for protocols without ports
+	__u16 remote_port;
+	__u8 family; // enum usage_family
+	__u8 proto;  // IPPROTO_*
+	__u8 pad[2];
+};
+
+struct flow_value {
+	__u64 ingress; // bytes sent by the device
+	__u64 egress;  // bytes sent to the device
+	__u64 ingress_packets;
+	__u64 egress_packets;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, MAX_FLOW_ENTRIES);
+	__type(key, struct flow_key);
+	__type(value, struct flow_value);
+} flow_map SEC(".maps");
 
 typedef enum {
 	UPDATE_USAGE_INGRESS,
@@ -30,35 +134,215 @@ typedef enum {
 
 static __always_inline __u64 nchar6_to_u64(unsigned char bytes[6])
 {
-	union {
-		char bytes[6];
-		__u64 i;
-	} ret;
-
-	ret.i = 0;
-#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
-	ret.bytes[0] = bytes[5];
-	ret.bytes[1] = bytes[4];
-	ret.bytes[2] = bytes[3];
-	ret.bytes[3] = bytes[2];
-	ret.bytes[4] = bytes[1];
-	ret.bytes[5] = bytes[0];
-#elif __BYTE_ORDER__ == __ORDER_BIG_ENDIAN__
-	ret.bytes[0] = bytes[0];
-	ret.bytes[1] = bytes[1];
-	ret.bytes[2] = bytes[2];
-	ret.bytes[3] = bytes[3];
-	ret.bytes[4] = bytes[4];
-	ret.bytes[5] = bytes[5];
-#endif
-
-	return ret.i;
+	// the layout of cilium's mac.Uint64, the first octet is the
+	// least significant byte so keys match the MACs userspace parses
+	return (__u64) bytes[0] | (__u64) bytes[1] << 8 |
+	       (__u64) bytes[2] << 16 | (__u64) bytes[3] << 24 |
+	       (__u64) bytes[4] << 32 | (__u64) bytes[5] << 40;
+}
+
+/*
+ * a token bucket refilled at the limit of the device, holding up to a
+ * second worth of traffic. returns zero if the packet should be dropped
+ */
+static __always_inline int rate_limit_pass(__u64 mac, __u64 len,
+					   update_usage_t traffic)
+{
+	struct token_bucket *bucket, new_bucket = {};
+	struct rate_limit *limit;
+	__u64 rate, burst, now, elapsed, tokens;
+	void *buckets;
+	int pass;
+
+	limit = bpf_map_lookup_elem(&rate_limit_map, &mac);
+	if (!limit)
+		return 1;
+
+	if (traffic == UPDATE_USAGE_INGRESS) {
+		rate = limit->ingress;
+		buckets = &ingress_bucket_map;
+	} else {
+		rate = limit->egress;
+		buckets = &egress_bucket_map;
+	}
+	if (!rate)
+		return 1;
+
+	burst = rate > MIN_BURST ? rate : MIN_BURST;
+	now = bpf_ktime_get_ns();
+
+	bucket = bpf_map_lookup_elem(buckets, &mac);
+	if (!bucket) {
+		new_bucket.tokens = burst > len ? burst - len : 0;
+		new_bucket.last = now;
+		// another cpu may have created it first, its bucket wins
+		bpf_map_update_elem(buckets, &mac, &new_bucket, BPF_NOEXIST);
+		return 1;
+	}
+
+	bpf_spin_lock(&bucket->lock);
+	// another cpu may have refilled it after now was read
+	elapsed = now > bucket->last ? now - bucket->last : 0;
+	// a second refills the whole bucket, this also keeps the product small
+	if (elapsed > NSEC_PER_SEC)
+		elapsed = NSEC_PER_SEC;
+	tokens = bucket->tokens + elapsed * rate / NSEC_PER_SEC;
+	if (tokens > burst)
+		tokens = burst;
+	if (now > bucket->last)
+		bucket->last = now;
+
+	pass = tokens >= len;
+	bucket->tokens = pass ? tokens - len : tokens;
+	bpf_spin_unlock(&bucket->lock);
+
+	return pass;
+}
+
+static __always_inline __u32 l4_proto(__u8 proto)
+{
+	switch (proto) {
+	case IPPROTO_TCP:
+		return USAGE_PROTO_TCP;
+	case IPPROTO_UDP:
+		return USAGE_PROTO_UDP;
+	case IPPROTO_ICMP:
+	case IPPROTO_ICMPV6:
+		return USAGE_PROTO_ICMP;
+	default:
+		return USAGE_PROTO_OTHER;
+	}
+}
+
+/*
+ * IPv6 extension headers aren't followed, so packets
+ * carrying them are counted as other
+ */
+static __always_inline void parse_l3(struct ethhdr *eth, void *data_end,
+				     __u32 *family, __u32 *proto)
+{
+	*proto = USAGE_PROTO_OTHER;
+
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *) (eth + 1);
+
+		*family = USAGE_FAMILY_IPV4;
+		if ((void *) (ip + 1) <= data_end)
+			*proto = l4_proto(ip->protocol);
+	} else {
+		struct ipv6hdr *ip6 = (void *) (eth + 1);
+
+		*family = USAGE_FAMILY_IPV6;
+		if ((void *) (ip6 + 1) <= data_end)
+			*proto = l4_proto(ip6->nexthdr);
+	}
+}
+
+struct ports {
+	__be16 source;
+	__be16 dest;
+};
+
+static __always_inline void parse_ports(void *l4, void *data_end, __u8 proto,
+					__u16 *source, __u16 *dest)
+{
+	struct ports *ports = l4;
+
+	*source = 0;
+	*dest = 0;
+	if (proto != IPPROTO_TCP && proto != IPPROTO_UDP)
+		return;
+	if ((void *) (ports + 1) > data_end)
+		return;
+
+	*source = bpf_ntohs(ports->source);
+	*dest = bpf_ntohs(ports->dest);
+}
+
+static __always_inline void update_flow(struct ethhdr *eth, void *data_end,
+					__u64 mac, __u64 len,
+					update_usage_t traffic)
+{
+	struct flow_value *value, new_value = {};
+	struct flow_key key = {};
+	__u16 source, dest;
+	__u32 config_key;
+	__u32 *enabled;
+
+	config_key = USAGE_CONFIG_FLOWS;
+	enabled = bpf_map_lookup_elem(&usage_config_map, &config_key);
+	if (!enabled || !*enabled)
+		return;
+
+	key.mac = mac;
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *) (eth + 1);
+
+		if ((void *) (ip + 1) > data_end)
+			return;
+
+		key.family = USAGE_FAMILY_IPV4;
+		key.proto = ip->protocol;
+		parse_ports((void *) ip + ip->ihl * 4, data_end, key.proto,
+			    &source, &dest);
+		if (traffic == UPDATE_USAGE_INGRESS) {
+			__builtin_memcpy(key.local, &ip->saddr, 4);
+			__builtin_memcpy(key.remote, &ip->daddr, 4);
+		} else {
+			__builtin_memcpy(key.local, &ip->daddr, 4);
+			__builtin_memcpy(key.remote, &ip->saddr, 4);
+		}
+	} else {
+		struct ipv6hdr *ip6 = (void *) (eth + 1);
+
+		if ((void *) (ip6 + 1) > data_end)
+			return;
+
+		key.family = USAGE_FAMILY_IPV6;
+		key.proto = ip6->nexthdr;
+		parse_ports(ip6 + 1, data_end, key.proto, &source, &dest);
+		if (traffic == UPDATE_USAGE_INGRESS) {
+			__builtin_memcpy(key.local, &ip6->saddr, 16);
+			__builtin_memcpy(key.remote, &ip6->daddr, 16);
+		} else {
+			__builtin_memcpy(key.local, &ip6->daddr, 16);
+			__builtin_memcpy(key.remote, &ip6->saddr, 16);
+		}
+	}
+
+	if (traffic == UPDATE_USAGE_INGRESS) {
+		key.local_port = source;
+		key.remote_port = dest;
+	} else {
+		key.local_port = dest;
+		key.remote_port = source;
+	}
+
+	value = bpf_map_lookup_elem(&flow_map, &key);
+	if (!value) {
+		if (traffic == UPDATE_USAGE_INGRESS) {
+			new_value.ingress = len;
+			new_value.ingress_packets = 1;
+		} else {
+			new_value.egress = len;
+			new_value.egress_packets = 1;
+		}
+		bpf_map_update_elem(&flow_map, &key, &new_value, BPF_ANY);
+	} else if (traffic == UPDATE_USAGE_INGRESS) {
+		__sync_fetch_and_add(&value->ingress, len);
+		__sync_fetch_and_add(&value->ingress_packets, 1);
+	} else {
+		__sync_fetch_and_add(&value->egress, len);
+		__sync_fetch_and_add(&value->egress_packets, 1);
+	}
 }
 
 static __always_inline int update_usage(void *map, struct __sk_buff *skb,
 					update_usage_t traffic)
 {
-	__u64 mac, len, *usage;
+	__u64 mac, len;
+	__u32 family, proto;
+	struct usage *usage, new_usage = {};
 
 	void *data_end = (void *)(long)skb->data_end;
 	struct ethhdr *eth = (void *)(long)skb->data;
@@ -78,25 +362,37 @@ static __always_inline int update_usage(void *map, struct __sk_buff *skb,
 		mac = nchar6_to_u64(eth->h_dest);
 	}
 
+	// dropped traffic isn't counted
+	if (!rate_limit_pass(mac, len, traffic))
+		return TCX_DROP;
+
+	parse_l3(eth, data_end, &family, &proto);
+	if (family >= USAGE_FAMILY_MAX || proto >= USAGE_PROTO_MAX)
+		return TCX_PASS;
+
 	usage = bpf_map_lookup_elem(map, &mac);
 	if (!usage) {
-		/* no entry in the map for this IP address yet. */
-		bpf_map_update_elem(map, &mac, &len, BPF_ANY);
+		/* no entry in the map for this mac address yet. */
+		new_usage.bytes[family][proto] = len;
+		new_usage.packets = 1;
+		bpf_map_update_elem(map, &mac, &new_usage, BPF_ANY);
 	} else {
-		__sync_fetch_and_add(usage, len);
+		__sync_fetch_and_add(&usage->bytes[family][proto], len);
+		__sync_fetch_and_add(&usage->packets, 1);
 	}
 
+	update_flow(eth, data_end, mac, len, traffic);
 	return TCX_PASS;
 }
 
 SEC("tc")
 int ingress_func(struct __sk_buff *skb)
 {
-	return update_usage(&ingress_ip4_usage_map, skb, UPDATE_USAGE_INGRESS);
+	return update_usage(&ingress_usage_map, skb, UPDATE_USAGE_INGRESS);
 }
 
 SEC("tc")
 int egress__func(struct __sk_buff *skb)
 {
-	return update_usage(&egress_ip4_usage_map, skb, UPDATE_USAGE_EGRESS);
+	return update_usage(&egress_usage_map, skb, UPDATE_USAGE_EGRESS);
 }
@@ -12,6 +12,48 @@ import (
 	"github.com/cilium/ebpf"
 )
 
+type bpfFlowKey struct {
+	Mac        uint64
+	Local      [16]uint8
+	Remote     [16]uint8
+	LocalPort  uint16
+	RemotePort uint16
+	Family     uint8
+	Proto      uint8
+	Pad        [2]uint8
+}
+
+type bpfFlowValue struct {
+	Ingress        uint64
+	Egress         uint64
+	IngressPackets uint64
+	EgressPackets  uint64
+}
+
+type bpfRateLimit struct {
+	Ingress uint64
+	Egress  uint64
+}
+
+type bpfTokenBucket struct {
+	Lock   struct{ Val uint32 }
+	_      [4]byte
+	Tokens uint64
+	Last   uint64
+}
+
+type bpfUsage struct {
+	Bytes   [2][4]uint64
+	Packets uint64
+}
+
+type bpfUsageConfig uint32
+
+const (
+	bpfUsageConfigUSAGE_CONFIG_FLOWS bpfUsageConfig = 0
+	bpfUsageConfigUSAGE_CONFIG_MAX   bpfUsageConfig = 1
+)
+
 // loadBpf returns the embedded CollectionSpec for bpf.
 func loadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -61,8 +103,13 @@ type bpfProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	EgressIp4UsageMap  *ebpf.MapSpec `ebpf:"egress_ip4_usage_map"`
-	IngressIp4UsageMap *ebpf.MapSpec `ebpf:"ingress_ip4_usage_map"`
+	EgressBucketMap  *ebpf.MapSpec `ebpf:"egress_bucket_map"`
+	EgressUsageMap   *ebpf.MapSpec `ebpf:"egress_usage_map"`
+	FlowMap          *ebpf.MapSpec `ebpf:"flow_map"`
+	IngressBucketMap *ebpf.MapSpec `ebpf:"ingress_bucket_map"`
+	IngressUsageMap  *ebpf.MapSpec `ebpf:"ingress_usage_map"`
+	RateLimitMap     *ebpf.MapSpec `ebpf:"rate_limit_map"`
+	UsageConfigMap   *ebpf.MapSpec `ebpf:"usage_config_map"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -84,14 +131,24 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	EgressIp4UsageMap  *ebpf.Map `ebpf:"egress_ip4_usage_map"`
-	IngressIp4UsageMap *ebpf.Map `ebpf:"ingress_ip4_usage_map"`
+	EgressBucketMap  *ebpf.Map `ebpf:"egress_bucket_map"`
+	EgressUsageMap   *ebpf.Map `ebpf:"egress_usage_map"`
+	FlowMap          *ebpf.Map `ebpf:"flow_map"`
+	IngressBucketMap *ebpf.Map `ebpf:"ingress_bucket_map"`
+	IngressUsageMap  *ebpf.Map `ebpf:"ingress_usage_map"`
+	RateLimitMap     *ebpf.Map `ebpf:"rate_limit_map"`
+	UsageConfigMap   *ebpf.Map `ebpf:"usage_config_map"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
-		m.EgressIp4UsageMap,
-		m.IngressIp4UsageMap,
+		m.EgressBucketMap,
+		m.EgressUsageMap,
+		m.FlowMap,
+		m.IngressBucketMap,
+		m.IngressUsageMap,
+		m.RateLimitMap,
+		m.UsageConfigMap,
 	)
 }
 
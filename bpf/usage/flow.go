@@ -0,0 +1,268 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/db"
+)
+
+const (
+	flowPruneInterval = time.Hour
+	// upper bound of the entries a flow search returns
+	MaxFlowEntries = 1000
+)
+
+var ErrFlowsDisabled = errors.New("flow accounting is disabled")
+
+// FlowKey is the traffic of a device with a remote end, the ports
+// devices pick for their side would make every connection its own flow
+type FlowKey struct {
+	HardwareAddr uint64
+	Remote       netip.Addr
+	// zero for protocols without ports
+	RemotePort uint16
+	// IP protocol number
+	Proto uint8
+}
+
+// FlowStat is in bytes and packets, ingress is
+// traffic sent by the device and egress traffic sent to it
+type FlowStat struct {
+	Ingress        uint64
+	Egress         uint64
+	IngressPackets uint64
+	EgressPackets  uint64
+}
+
+type FlowTalker struct {
+	HardwareAddr uint64
+	FlowStat
+}
+
+type FlowDestination struct {
+	Remote     netip.Addr
+	RemotePort uint16
+	Proto      uint8
+	FlowStat
+}
+
+// FlowSearch filters the stored flows, zero values match everything
+type FlowSearch struct {
+	Start        time.Time
+	Stop         time.Time
+	HardwareAddr uint64
+	Limit        int
+}
+
+func (fs *FlowStat) add(other *FlowStat) {
+	fs.Ingress += other.Ingress
+	fs.Egress += other.Egress
+	fs.IngressPackets += other.IngressPackets
+	fs.EgressPackets += other.EgressPackets
+}
+
+func flowKey(key *bpfFlowKey) FlowKey {
+	remote := netip.AddrFrom16(key.Remote)
+	if key.Family == FamilyIPv4 {
+		remote = netip.AddrFrom4([4]byte(key.Remote[:4]))
+	}
+
+	return FlowKey{
+		HardwareAddr: key.Mac,
+		Remote:       remote,
+		RemotePort:   key.RemotePort,
+		Proto:        key.Proto,
+	}
+}
+
+func (u *Usage) drainFlows(m *ebpf.Map) error {
+	batchKeys := make([]bpfFlowKey, 4096)
+	batchValues := make([]bpfFlowValue, 4096)
+
+	cursor := ebpf.MapBatchCursor{}
+	for {
+		count, err := m.BatchLookupAndDelete(&cursor, batchKeys, batchValues, nil)
+		u.Mutex.Lock()
+		for i := 0; i < count; i++ {
+			key := flowKey(&batchKeys[i])
+			stat := u.flows[key]
+			stat.add(&FlowStat{
+				Ingress:        batchValues[i].Ingress,
+				Egress:         batchValues[i].Egress,
+				IngressPackets: batchValues[i].IngressPackets,
+				EgressPackets:  batchValues[i].EgressPackets,
+			})
+			u.flows[key] = stat
+		}
+		u.Mutex.Unlock()
+
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pushFlows writes the flows drained since the last push, they're
+// dropped on failure so an unreachable database can't grow them
+// without bound
+func (u *Usage) pushFlows(queries *db.Queries, ctxDb context.Context) error {
+	var params []db.EnterFlowParams
+	now := time.Now()
+
+	u.Mutex.Lock()
+	flows := u.flows
+	since := u.flowsSince
+	u.flows = make(map[FlowKey]FlowStat)
+	u.flowsSince = now
+	u.Mutex.Unlock()
+
+	for key, stat := range flows {
+		params = append(params, db.EnterFlowParams{
+			Hardwareaddr:   int64(key.HardwareAddr),
+			Starttime:      db.Timestamp(since),
+			Stoptime:       db.Timestamp(now),
+			Remote:         key.Remote,
+			Remoteport:     int32(key.RemotePort),
+			Proto:          int16(key.Proto),
+			Ingress:        int64(stat.Ingress),
+			Egress:         int64(stat.Egress),
+			Ingresspackets: int64(stat.IngressPackets),
+			Egresspackets:  int64(stat.EgressPackets),
+		})
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	_, err := queries.EnterFlow(ctxDb, params)
+	return err
+}
+
+func (u *Usage) pruneFlows(queries *db.Queries, ctxDb context.Context) error {
+	if u.flowRetention == 0 {
+		return nil
+	}
+
+	return queries.DeleteFlow(ctxDb, db.Timestamp(time.Now().Add(-u.flowRetention)))
+}
+
+// flowRange pushes the pending flows so searches include
+// them, and fills in the defaults of s
+func (u *Usage) flowRange(queries *db.Queries, ctxDb context.Context, s *FlowSearch) (pgtype.Timestamp, pgtype.Timestamp, int32, error) {
+	if !u.flowsEnabled {
+		return pgtype.Timestamp{}, pgtype.Timestamp{}, 0, ErrFlowsDisabled
+	}
+
+	err := u.pushFlows(queries, ctxDb)
+	if err != nil {
+		log.Printf("writing flows: %s", err)
+		return pgtype.Timestamp{}, pgtype.Timestamp{}, 0, err
+	}
+
+	stop := s.Stop
+	if stop.IsZero() {
+		stop = time.Now().Add(time.Minute)
+	}
+	limit := int32(MaxFlowEntries)
+	if s.Limit > 0 && s.Limit < MaxFlowEntries {
+		limit = int32(s.Limit)
+	}
+
+	return db.Timestamp(s.Start), db.Timestamp(stop), limit, nil
+}
+
+// TopTalkers returns the devices that moved the most traffic,
+// only s.HardwareAddr if it's set
+func (u *Usage) TopTalkers(queries *db.Queries, ctxDb context.Context, s FlowSearch) ([]FlowTalker, error) {
+	var talkers []FlowTalker
+
+	start, stop, limit, err := u.flowRange(queries, ctxDb, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	params := db.GetTopTalkersParams{
+		StartTime: start,
+		StopTime:  stop,
+		MaxRows:   limit,
+	}
+	if s.HardwareAddr != 0 {
+		params.HardwareAddr = pgtype.Int8{
+			Int64: int64(s.HardwareAddr),
+			Valid: true,
+		}
+	}
+
+	rows, err := queries.GetTopTalkers(ctxDb, params)
+	if err != nil {
+		log.Printf("reading flows: %s", err)
+		return nil, err
+	}
+	for _, row := range rows {
+		talkers = append(talkers, FlowTalker{
+			HardwareAddr: uint64(row.Hardwareaddr),
+			FlowStat: FlowStat{
+				Ingress:        uint64(row.Ingress),
+				Egress:         uint64(row.Egress),
+				IngressPackets: uint64(row.Ingresspackets),
+				EgressPackets:  uint64(row.Egresspackets),
+			},
+		})
+	}
+
+	return talkers, nil
+}
+
+// TopDestinations returns the remote ends that moved the most
+// traffic, for a single device if s.HardwareAddr is set
+func (u *Usage) TopDestinations(queries *db.Queries, ctxDb context.Context, s FlowSearch) ([]FlowDestination, error) {
+	var destinations []FlowDestination
+
+	start, stop, limit, err := u.flowRange(queries, ctxDb, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	params := db.GetTopDestinationsParams{
+		StartTime: start,
+		StopTime:  stop,
+		MaxRows:   limit,
+	}
+	if s.HardwareAddr != 0 {
+		params.HardwareAddr = pgtype.Int8{
+			Int64: int64(s.HardwareAddr),
+			Valid: true,
+		}
+	}
+
+	rows, err := queries.GetTopDestinations(ctxDb, params)
+	if err != nil {
+		log.Printf("reading flows: %s", err)
+		return nil, err
+	}
+	for _, row := range rows {
+		destinations = append(destinations, FlowDestination{
+			Remote:     row.Remote,
+			RemotePort: uint16(row.Remoteport),
+			Proto:      uint8(row.Proto),
+			FlowStat: FlowStat{
+				Ingress:        uint64(row.Ingress),
+				Egress:         uint64(row.Egress),
+				IngressPackets: uint64(row.Ingresspackets),
+				EgressPackets:  uint64(row.Egresspackets),
+			},
+		})
+	}
+
+	return destinations, nil
+}
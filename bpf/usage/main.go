@@ -11,6 +11,7 @@ import (
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/config"
 	"sinanmohd.com/redq/db"
 )
 
@@ -21,103 +22,224 @@ type UsageStat struct {
 	BandwidthEgress  uint64
 	Ingress          uint64
 	Egress           uint64
+	// packets per second and since the last push
+	BandwidthIngressPackets uint64
+	BandwidthEgressPackets  uint64
+	IngressPackets          uint64
+	EgressPackets           uint64
+	// the same by address family and transport protocol
+	BandwidthIngressTraffic Traffic
+	BandwidthEgressTraffic  Traffic
+	IngressTraffic          Traffic
+	EgressTraffic           Traffic
 }
 
-type usageMap map[uint64]UsageStat
-type Usage struct {
-	Data                    usageMap
-	Mutex                   sync.RWMutex
+// UsageKey identifies the traffic of a device on a single interface
+type UsageKey struct {
+	HardwareAddr uint64
+	Iface        string
+}
+
+type usageMap map[UsageKey]UsageStat
+
+// attachment holds the eBPF objects loaded for a single interface,
+// each interface gets its own maps so the counters don't mix
+type attachment struct {
+	iface                   *net.Interface
 	objs                    bpfObjects
 	egressLink, ingressLink link.Link
 }
 
+// Hook is called from Run every time the counters are updated
+type Hook func(u *Usage)
+
+type Usage struct {
+	Data        usageMap
+	Mutex       sync.RWMutex
+	attachments []*attachment
+	hooks       []Hook
+	// flows drained since flowsSince, guarded by Mutex
+	flows         map[FlowKey]FlowStat
+	flowsSince    time.Time
+	flowsEnabled  bool
+	flowRetention time.Duration
+}
+
 func Close(u *Usage, queries *db.Queries, ctxDb context.Context) {
 	err := u.UpdateDb(queries, ctxDb, false)
 	if err != nil {
 		log.Printf("updating Database: %s", err)
 	}
 
-	u.objs.Close()
-	u.ingressLink.Close()
-	u.egressLink.Close()
+	err = u.pushFlows(queries, ctxDb)
+	if err != nil {
+		log.Printf("writing flows: %s", err)
+	}
+
+	u.close()
 }
 
-func New(iface *net.Interface) (*Usage, error) {
-	var err error
+func New(cfg *config.Config) (*Usage, error) {
 	var u Usage
 
-	if err := loadBpfObjects(&u.objs, nil); err != nil {
+	for _, name := range cfg.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Printf("lookup network: %s", err)
+			u.close()
+			return nil, err
+		}
+
+		a, err := attach(iface)
+		if err != nil {
+			u.close()
+			return nil, err
+		}
+		u.attachments = append(u.attachments, a)
+
+		if cfg.Usage.Flows.Enabled {
+			err = a.objs.UsageConfigMap.Put(uint32(bpfUsageConfigUSAGE_CONFIG_FLOWS), uint32(1))
+			if err != nil {
+				log.Printf("enabling flow accounting on %s: %s", name, err)
+				u.close()
+				return nil, err
+			}
+		}
+	}
+
+	u.Data = make(usageMap)
+	u.flows = make(map[FlowKey]FlowStat)
+	u.flowsSince = time.Now()
+	u.flowsEnabled = cfg.Usage.Flows.Enabled
+	u.flowRetention = cfg.Usage.Flows.Retention
+	return &u, nil
+}
+
+func (u *Usage) close() {
+	for _, a := range u.attachments {
+		a.close()
+	}
+}
+
+func attach(iface *net.Interface) (*attachment, error) {
+	var err error
+	a := attachment{iface: iface}
+
+	if err := loadBpfObjects(&a.objs, nil); err != nil {
 		log.Printf("loading objects: %s", err)
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			u.objs.Close()
+			a.objs.Close()
 		}
 	}()
 
-	u.ingressLink, err = link.AttachTCX(link.TCXOptions{
+	a.ingressLink, err = link.AttachTCX(link.TCXOptions{
 		Interface: iface.Index,
-		Program:   u.objs.IngressFunc,
+		Program:   a.objs.IngressFunc,
 		Attach:    ebpf.AttachTCXIngress,
 	})
 	if err != nil {
-		log.Printf("could not attach TCx program: %s", err)
+		log.Printf("could not attach TCx program to %s: %s", iface.Name, err)
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			u.ingressLink.Close()
+			a.ingressLink.Close()
 		}
 	}()
 
-	u.egressLink, err = link.AttachTCX(link.TCXOptions{
+	a.egressLink, err = link.AttachTCX(link.TCXOptions{
 		Interface: iface.Index,
-		Program:   u.objs.EgressFunc,
+		Program:   a.objs.EgressFunc,
 		Attach:    ebpf.AttachTCXEgress,
 	})
 	if err != nil {
-		log.Printf("could not attach TCx program: %s", err)
+		log.Printf("could not attach TCx program to %s: %s", iface.Name, err)
 		return nil, err
 	}
 
-	u.Data = make(usageMap)
-	return &u, nil
+	return &a, nil
+}
+
+func (a *attachment) close() {
+	a.objs.Close()
+	a.ingressLink.Close()
+	a.egressLink.Close()
+}
+
+// AddHook registers a hook, it must be called before Run
+func (u *Usage) AddHook(hook Hook) {
+	u.hooks = append(u.hooks, hook)
 }
 
-func (u *Usage) Run(iface *net.Interface, queries *db.Queries, ctxDb context.Context) {
+func (u *Usage) Run(queries *db.Queries, ctxDb context.Context) {
 	bpfTicker := time.NewTicker(time.Second)
 	defer bpfTicker.Stop()
 	dbTicker := time.NewTicker(time.Minute)
 	defer dbTicker.Stop()
+	pruneTicker := time.NewTicker(flowPruneInterval)
+	defer pruneTicker.Stop()
+	day := midnight(time.Now())
 
 	for {
 		select {
 		case <-bpfTicker.C:
-			err := u.update(u.objs.IngressIp4UsageMap, u.objs.EgressIp4UsageMap)
+			// every quota period starts at midnight, pushing the
+			// counters then keeps them from spanning two periods
+			if today := midnight(time.Now()); !today.Equal(day) {
+				err := u.UpdateDb(queries, ctxDb, false)
+				if err != nil {
+					log.Printf("updating Database: %s", err)
+				}
+				day = today
+			}
+
+			err := u.update()
 			if err != nil {
 				log.Printf("updating usageMap: %s", err)
 			}
+
+			for _, hook := range u.hooks {
+				hook(u)
+			}
 		case <-dbTicker.C:
 			err := u.UpdateDb(queries, ctxDb, true)
 			if err != nil {
 				log.Printf("updating Database: %s", err)
 			}
+
+			err = u.pushFlows(queries, ctxDb)
+			if err != nil {
+				log.Printf("writing flows: %s", err)
+			}
+		case <-pruneTicker.C:
+			err := u.pruneFlows(queries, ctxDb)
+			if err != nil {
+				log.Printf("pruning flows: %s", err)
+			}
 		}
 	}
 }
 
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
 func (u *Usage) UpdateDb(queries *db.Queries, ctxDb context.Context, ifExpired bool) error {
 	timeStart := time.Now()
 
 	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
 	for key, value := range u.Data {
 		if ifExpired && !value.expired(&timeStart) {
 			continue
 		}
 
 		err := queries.EnterUsage(ctxDb, db.EnterUsageParams{
-			Hardwareaddr: int64(key),
+			Hardwareaddr: int64(key.HardwareAddr),
+			Iface:        key.Iface,
 			Starttime: pgtype.Timestamp{
 				Time:  value.lastDbPush,
 				Valid: true,
@@ -126,8 +248,22 @@ func (u *Usage) UpdateDb(queries *db.Queries, ctxDb context.Context, ifExpired b
 				Time:  value.lastSeen,
 				Valid: true,
 			},
-			Egress:  int64(value.Egress),
-			Ingress: int64(value.Ingress),
+			Egress:         int64(value.Egress),
+			Ingress:        int64(value.Ingress),
+			Ingresspackets: int64(value.IngressPackets),
+			Egresspackets:  int64(value.EgressPackets),
+			Ingressipv4:    int64(value.IngressTraffic.Family(FamilyIPv4)),
+			Ingressipv6:    int64(value.IngressTraffic.Family(FamilyIPv6)),
+			Ingresstcp:     int64(value.IngressTraffic.Proto(ProtoTcp)),
+			Ingressudp:     int64(value.IngressTraffic.Proto(ProtoUdp)),
+			Ingressicmp:    int64(value.IngressTraffic.Proto(ProtoIcmp)),
+			Ingressother:   int64(value.IngressTraffic.Proto(ProtoOther)),
+			Egressipv4:     int64(value.EgressTraffic.Family(FamilyIPv4)),
+			Egressipv6:     int64(value.EgressTraffic.Family(FamilyIPv6)),
+			Egresstcp:      int64(value.EgressTraffic.Proto(ProtoTcp)),
+			Egressudp:      int64(value.EgressTraffic.Proto(ProtoUdp)),
+			Egressicmp:     int64(value.EgressTraffic.Proto(ProtoIcmp)),
+			Egressother:    int64(value.EgressTraffic.Proto(ProtoOther)),
 		})
 		if err != nil {
 			return err
@@ -135,11 +271,20 @@ func (u *Usage) UpdateDb(queries *db.Queries, ctxDb context.Context, ifExpired b
 
 		delete(u.Data, key)
 	}
-	u.Mutex.Unlock()
 
 	return nil
 }
 
+// Since returns the start of the period the counters cover,
+// older traffic has already been pushed to the database
+func (us *UsageStat) Since() time.Time {
+	return us.lastDbPush
+}
+
+func (us *UsageStat) LastSeen() time.Time {
+	return us.lastSeen
+}
+
 func (us *UsageStat) expired(timeStart *time.Time) bool {
 	timeDiff := timeStart.Sub(us.lastSeen)
 	if timeDiff > time.Minute {
@@ -154,44 +299,87 @@ func (us *UsageStat) expired(timeStart *time.Time) bool {
 	return false
 }
 
-func (u *Usage) update(ingress *ebpf.Map, egress *ebpf.Map) error {
+func (u *Usage) update() error {
 	timeStart := time.Now()
-	batchKeys := make([]uint64, 4096)
-	batchValues := make([]uint64, 4096)
-	var key uint64
 
 	u.Mutex.Lock()
 	for key, value := range u.Data {
 		value.BandwidthIngress = 0
 		value.BandwidthEgress = 0
+		value.BandwidthIngressPackets = 0
+		value.BandwidthEgressPackets = 0
+		value.BandwidthIngressTraffic = Traffic{}
+		value.BandwidthEgressTraffic = Traffic{}
 		u.Data[key] = value
 	}
 	u.Mutex.Unlock()
 
+	for _, a := range u.attachments {
+		err := u.drain(a.objs.IngressUsageMap, a.iface.Name, &timeStart, true)
+		if err != nil {
+			return err
+		}
+
+		err = u.drain(a.objs.EgressUsageMap, a.iface.Name, &timeStart, false)
+		if err != nil {
+			return err
+		}
+
+		if u.flowsEnabled {
+			err = u.drainFlows(a.objs.FlowMap)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (u *Usage) drain(m *ebpf.Map, iface string, timeStart *time.Time, ingress bool) error {
+	batchKeys := make([]uint64, 4096)
+	batchValues := make([]bpfUsage, 4096)
+
 	cursor := ebpf.MapBatchCursor{}
 	for {
-		_, err := ingress.BatchLookupAndDelete(&cursor, batchKeys, batchValues, nil)
+		count, err := m.BatchLookupAndDelete(&cursor, batchKeys, batchValues, nil)
 		u.Mutex.Lock()
-		for i := range batchKeys {
-			if batchValues[i] == 0 {
+		for i := 0; i < count; i++ {
+			packets := batchValues[i].Packets
+			traffic := Traffic(batchValues[i].Bytes)
+			bytes := traffic.Total()
+			if bytes == 0 {
 				continue
 			}
 
-			key = batchKeys[i]
+			key := UsageKey{
+				HardwareAddr: batchKeys[i],
+				Iface:        iface,
+			}
 			usage, ok := u.Data[key]
-			if ok {
-				usage.BandwidthIngress = batchValues[i]
-				usage.Ingress += batchValues[i]
-				usage.lastSeen = timeStart
-				u.Data[key] = usage
-			} else {
-				u.Data[key] = UsageStat{
-					BandwidthIngress: batchValues[i],
-					Ingress:          batchValues[i],
-					lastDbPush:       timeStart,
-					lastSeen:         timeStart,
+			if !ok {
+				usage = UsageStat{
+					lastDbPush: *timeStart,
 				}
 			}
+
+			if ingress {
+				usage.BandwidthIngress = bytes
+				usage.BandwidthIngressTraffic = traffic
+				usage.Ingress += bytes
+				usage.BandwidthIngressPackets = packets
+				usage.IngressPackets += packets
+				usage.IngressTraffic.add(&traffic)
+			} else {
+				usage.BandwidthEgress = bytes
+				usage.BandwidthEgressTraffic = traffic
+				usage.Egress += bytes
+				usage.BandwidthEgressPackets = packets
+				usage.EgressPackets += packets
+				usage.EgressTraffic.add(&traffic)
+			}
+			usage.lastSeen = *timeStart
+			u.Data[key] = usage
 		}
 		u.Mutex.Unlock()
 
@@ -202,39 +390,45 @@ func (u *Usage) update(ingress *ebpf.Map, egress *ebpf.Map) error {
 		}
 	}
 
-	cursor = ebpf.MapBatchCursor{}
-	for {
-		_, err := egress.BatchLookupAndDelete(&cursor, batchKeys, batchValues, nil)
-		u.Mutex.Lock()
-		for i := range batchKeys {
-			if batchValues[i] == 0 {
-				continue
-			}
+	return nil
+}
 
-			key = batchKeys[i]
-			usage, ok := u.Data[key]
-			if ok {
-				usage.BandwidthEgress = batchValues[i]
-				usage.Egress += batchValues[i]
-				usage.lastSeen = timeStart
-				u.Data[key] = usage
-			} else {
-				u.Data[key] = UsageStat{
-					BandwidthEgress: batchValues[i],
-					Egress:          batchValues[i],
-					lastDbPush:      timeStart,
-					lastSeen:        timeStart,
-				}
+// SetRateLimit limits the traffic of a device in bytes per second, zero
+// lifts the limit of a direction. every interface has its own buckets,
+// so a device may send at the limit on each interface it's seen on
+func (u *Usage) SetRateLimit(mac uint64, ingress, egress uint64) error {
+	for _, a := range u.attachments {
+		var err error
+
+		if ingress == 0 && egress == 0 {
+			err = deleteKey(a.objs.RateLimitMap, mac)
+			if err == nil {
+				err = deleteKey(a.objs.IngressBucketMap, mac)
+			}
+			if err == nil {
+				err = deleteKey(a.objs.EgressBucketMap, mac)
 			}
+		} else {
+			err = a.objs.RateLimitMap.Put(mac, bpfRateLimit{
+				Ingress: ingress,
+				Egress:  egress,
+			})
 		}
-		u.Mutex.Unlock()
-
-		if errors.Is(err, ebpf.ErrKeyNotExist) {
-			break
-		} else if err != nil {
+		if err != nil {
+			log.Printf("setting rate limit on %s: %s", a.iface.Name, err)
 			return err
 		}
 	}
 
 	return nil
 }
+
+// deleteKey deletes a key that may not exist
+func deleteKey(m *ebpf.Map, key uint64) error {
+	err := m.Delete(key)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,58 @@
+package usage
+
+// address families, in the order of the bpf map value
+const (
+	FamilyIPv4 = iota
+	FamilyIPv6
+	familyMax
+)
+
+// transport protocols, in the order of the bpf map value
+const (
+	ProtoTcp = iota
+	ProtoUdp
+	ProtoIcmp
+	ProtoOther
+	protoMax
+)
+
+// Traffic is the number of bytes by address family and transport protocol
+type Traffic [familyMax][protoMax]uint64
+
+func (t *Traffic) add(other *Traffic) {
+	for family := range t {
+		for proto := range t[family] {
+			t[family][proto] += other[family][proto]
+		}
+	}
+}
+
+func (t *Traffic) Total() uint64 {
+	var total uint64
+
+	for family := range t {
+		total += t.Family(family)
+	}
+
+	return total
+}
+
+func (t *Traffic) Family(family int) uint64 {
+	var total uint64
+
+	for _, bytes := range t[family] {
+		total += bytes
+	}
+
+	return total
+}
+
+func (t *Traffic) Proto(proto int) uint64 {
+	var total uint64
+
+	for family := range t {
+		total += t[family][proto]
+	}
+
+	return total
+}
@@ -3,46 +3,81 @@ package main
 import (
 	"context"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"sinanmohd.com/redq/api"
+	"sinanmohd.com/redq/bpf/filter"
+	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/config"
 	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/device"
 	"sinanmohd.com/redq/dns"
-	"sinanmohd.com/redq/bpf/usage"
-	"sinanmohd.com/redq/bpf/filter"
+	"sinanmohd.com/redq/event"
+	"sinanmohd.com/redq/neigh"
+	"sinanmohd.com/redq/oui"
+	"sinanmohd.com/redq/quota"
+	"sinanmohd.com/redq/ratelimit"
+	"sinanmohd.com/redq/schedule"
 )
 
 func main() {
-	iface, err := net.InterfaceByName("wlan0")
+	cfg, err := config.New()
 	if err != nil {
-		log.Fatalf("lookup network: %s", err)
+		log.Fatalf("loading config: %s", err)
 	}
 
 	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, "user=redq_ebpf dbname=redq_ebpf")
+	pool, err := pgxpool.New(ctx, cfg.Database.Dsn)
 	if err != nil {
 		log.Fatalf("connecting database: %s", err)
 	}
-	defer conn.Close(ctx)
-	queries := db.New(conn)
+	defer pool.Close()
+	queries := db.New(pool)
 
-	d, err := dns.New(queries, ctx)
+	b := event.New()
+	n, err := neigh.New()
+	if err != nil {
+		os.Exit(0)
+	}
+	d, err := dns.New(cfg, n, queries, ctx)
+	if err != nil {
+		os.Exit(0)
+	}
+	a, err := api.New(cfg)
+	if err != nil {
+		os.Exit(0)
+	}
+	f, err := filter.New(cfg, b, queries, ctx)
+	if err != nil {
+		os.Exit(0)
+	}
+	u, err := usage.New(cfg)
+	if err != nil {
+		os.Exit(0)
+	}
+	q, err := quota.New(f, b, queries, ctx)
+	if err != nil {
+		os.Exit(0)
+	}
+	u.AddHook(q.Evaluate)
+	o, err := oui.New(cfg)
 	if err != nil {
 		os.Exit(0)
 	}
-	a, err := api.New()
+	inv, err := device.New(cfg, n, o, b, queries, ctx)
 	if err != nil {
 		os.Exit(0)
 	}
-	f, err := filter.New(iface, queries, ctx)
+	u.AddHook(inv.Observe)
+	u.AddHook(b.Updated)
+	r, err := ratelimit.New(u, queries, ctx)
 	if err != nil {
 		os.Exit(0)
 	}
-	u, err := usage.New(iface)
+	s, err := schedule.New(f, d, queries, ctx)
 	if err != nil {
 		os.Exit(0)
 	}
@@ -52,13 +87,17 @@ func main() {
 	go func() {
 		<-sigs
 		usage.Close(u, queries, ctx)
+		device.Close(inv)
 		filter.Close(f)
 		api.Close(a)
 		os.Exit(0)
 	}()
 
-	go u.Run(iface, queries, ctx)
+	go n.Run()
+	go u.Run(queries, ctx)
 	go d.Run()
+	go s.Run()
+	go inv.Run()
 
-	a.Run(u, d, f, queries, ctx)
+	a.Run(u, d, f, q, s, r, inv, b, queries, ctx)
 }
@@ -0,0 +1,494 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultPath = "/etc/redq/redq.toml"
+
+// responses to blocked DNS queries
+const (
+	// empty NOERROR reply
+	BlockNoData   = "nodata"
+	BlockNxDomain = "nxdomain"
+	BlockRefused  = "refused"
+	// 0.0.0.0 and :: for A and AAAA queries
+	BlockNull = "null"
+	// sinkhole_ipv4 and sinkhole_ipv6 for A and AAAA queries
+	BlockSinkhole = "sinkhole"
+)
+
+// how queries are spread over the upstream resolvers
+const (
+	// in the configured order, moving on when one fails
+	StrategySequential = "sequential"
+	// rotate between them for every query
+	StrategyRoundRobin = "round-robin"
+	// lowest average latency first
+	StrategyFastest = "fastest"
+	// query all of them at once, the first answer wins
+	StrategyParallel = "parallel"
+)
+
+type Database struct {
+	Dsn string `toml:"dsn"`
+}
+
+type Cache struct {
+	// number of cached responses, zero disables the cache
+	Size int `toml:"size"`
+	// upper bound for the TTL of positive and negative responses
+	MaxTtl         time.Duration `toml:"max_ttl"`
+	MaxNegativeTtl time.Duration `toml:"max_negative_ttl"`
+	// refresh frequently used entries before they expire
+	Prefetch bool `toml:"prefetch"`
+}
+
+// Listener is an encrypted DNS listener, an empty address disables it
+type Listener struct {
+	Addr     string `toml:"addr"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// URL path of DNS over HTTPS queries
+	Path string `toml:"path"`
+}
+
+type Upstream struct {
+	// udp://, tcp://, tls:// or https:// URLs, a bare address is plain
+	// DNS. resolv_conf is used if empty
+	Servers  []string      `toml:"servers"`
+	Strategy string        `toml:"strategy"`
+	Timeout  time.Duration `toml:"timeout"`
+}
+
+type Log struct {
+	Enabled bool `toml:"enabled"`
+	// entries older than this are deleted, zero keeps them forever
+	Retention time.Duration `toml:"retention"`
+}
+
+type Dns struct {
+	// UDP and TCP listening address
+	Addr         string `toml:"addr"`
+	ResolvConf   string `toml:"resolv_conf"`
+	BlockMode    string `toml:"block_mode"`
+	SinkholeIPv4 string `toml:"sinkhole_ipv4"`
+	SinkholeIPv6 string `toml:"sinkhole_ipv6"`
+	// blocklists are only imported from files in here
+	ListDir  string   `toml:"list_dir"`
+	Cache    Cache    `toml:"cache"`
+	Upstream Upstream `toml:"upstream"`
+	Log      Log      `toml:"log"`
+	Tls      Listener `toml:"tls"`
+	Https    Listener `toml:"https"`
+}
+
+type Usage struct {
+	// per flow accounting, flows are kept as long as the retention
+	Flows Log `toml:"flows"`
+}
+
+type Device struct {
+	// dnsmasq lease file to learn addresses and host
+	// names from, empty to rely on the neighbour table alone
+	Leases string `toml:"leases"`
+	// IEEE oui.txt to look vendors up in, empty for the embedded
+	// excerpt which only knows a few dozen common vendors. it's
+	// read at startup so it can be updated offline
+	Oui string `toml:"oui"`
+}
+
+type Api struct {
+	SockPath string `toml:"sock_path"`
+	// connections are closed after waiting this long for a request
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+	// and when a response takes longer than this to write
+	WriteTimeout time.Duration `toml:"write_timeout"`
+}
+
+type Config struct {
+	Interfaces []string `toml:"interfaces"`
+	Database   Database `toml:"database"`
+	Dns        Dns      `toml:"dns"`
+	Usage      Usage    `toml:"usage"`
+	Device     Device   `toml:"device"`
+	Api        Api      `toml:"api"`
+}
+
+// option is a setting that can be overridden from
+// the environment and the command line
+type option struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+type stringValue struct {
+	p *string
+}
+
+func (s stringValue) String() string {
+	if s.p == nil {
+		return ""
+	}
+
+	return *s.p
+}
+
+func (s stringValue) Set(value string) error {
+	*s.p = value
+	return nil
+}
+
+// listValue is a comma separated list of strings
+type listValue struct {
+	p *[]string
+}
+
+func (l listValue) String() string {
+	if l.p == nil {
+		return ""
+	}
+
+	return strings.Join(*l.p, ",")
+}
+
+func (l listValue) Set(value string) error {
+	var list []string
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	*l.p = list
+	return nil
+}
+
+func defaults() *Config {
+	return &Config{
+		Interfaces: []string{"wlan0"},
+		Database: Database{
+			Dsn: "user=redq_ebpf dbname=redq_ebpf",
+		},
+		Dns: Dns{
+			Addr:       ":53",
+			ResolvConf: "/etc/resolv.conf",
+			ListDir:    "/etc/redq/lists",
+			BlockMode:  BlockNoData,
+			Cache: Cache{
+				Size:           4096,
+				MaxTtl:         24 * time.Hour,
+				MaxNegativeTtl: 3 * time.Hour,
+				Prefetch:       true,
+			},
+			Upstream: Upstream{
+				Strategy: StrategySequential,
+				Timeout:  2 * time.Second,
+			},
+			Log: Log{
+				Enabled:   true,
+				Retention: 7 * 24 * time.Hour,
+			},
+			Https: Listener{
+				Path: "/dns-query",
+			},
+		},
+		Usage: Usage{
+			Flows: Log{
+				Retention: 7 * 24 * time.Hour,
+			},
+		},
+		Api: Api{
+			SockPath:     "/tmp/redq_ebpf.sock",
+			IdleTimeout:  time.Minute,
+			WriteTimeout: 10 * time.Second,
+		},
+	}
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"interfaces", "REDQ_INTERFACES", "comma separated network interfaces to monitor and filter", listValue{&c.Interfaces}},
+		{"dsn", "REDQ_DATABASE_DSN", "PostgreSQL connection string", stringValue{&c.Database.Dsn}},
+		{"dns-addr", "REDQ_DNS_ADDR", "address for the DNS server to listen on", stringValue{&c.Dns.Addr}},
+		{"resolv-conf", "REDQ_DNS_RESOLV_CONF", "resolv.conf to read upstream DNS servers from", stringValue{&c.Dns.ResolvConf}},
+		{"dns-upstreams", "REDQ_DNS_UPSTREAMS", "comma separated upstream DNS servers", listValue{&c.Dns.Upstream.Servers}},
+		{"dns-upstream-strategy", "REDQ_DNS_UPSTREAM_STRATEGY", "how queries are spread over the upstream DNS servers", stringValue{&c.Dns.Upstream.Strategy}},
+		{"dns-block-mode", "REDQ_DNS_BLOCK_MODE", "response to blocked DNS queries", stringValue{&c.Dns.BlockMode}},
+		{"dhcp-leases", "REDQ_DEVICE_LEASES", "dnsmasq lease file to learn devices from", stringValue{&c.Device.Leases}},
+		{"oui", "REDQ_DEVICE_OUI", "IEEE oui.txt to look device vendors up in", stringValue{&c.Device.Oui}},
+		{"sock", "REDQ_API_SOCK_PATH", "path of the API unix socket", stringValue{&c.Api.SockPath}},
+	}
+}
+
+// New builds the configuration from, in increasing order of precedence,
+// built-in defaults, the TOML file, REDQ_* environment variables and
+// command line flags
+func New() (*Config, error) {
+	c := defaults()
+	options := c.options()
+
+	path := flag.String("config", defaultPath, "path to the TOML configuration file")
+	flagValues := make(map[string]*string)
+	for _, o := range options {
+		flagValues[o.flag] = flag.String(o.flag, "", o.usage)
+	}
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	err := c.load(*path, set["config"])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range options {
+		value, ok := os.LookupEnv(o.env)
+		if !ok {
+			continue
+		}
+
+		err = o.value.Set(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", o.env, err)
+		}
+	}
+
+	for _, o := range options {
+		if !set[o.flag] {
+			continue
+		}
+
+		err = o.value.Set(*flagValues[o.flag])
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %w", o.flag, err)
+		}
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ValidBlockMode accepts one of the Block* modes, or an
+// IP address to sinkhole the blocked names to
+func ValidBlockMode(mode string) error {
+	switch mode {
+	case BlockNoData, BlockNxDomain, BlockRefused, BlockNull, BlockSinkhole:
+		return nil
+	}
+
+	if net.ParseIP(mode) == nil {
+		return fmt.Errorf("invalid block mode '%s'", mode)
+	}
+	return nil
+}
+
+func validIP(value string, ipv4 bool) error {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address '%s'", value)
+	}
+	if (ip.To4() != nil) != ipv4 {
+		return fmt.Errorf("wrong address family for '%s'", value)
+	}
+
+	return nil
+}
+
+func ValidStrategy(strategy string) error {
+	switch strategy {
+	case StrategySequential, StrategyRoundRobin, StrategyFastest, StrategyParallel:
+		return nil
+	default:
+		return fmt.Errorf("invalid strategy '%s'", strategy)
+	}
+}
+
+// ValidUpstream accepts a host with an optional port for plain DNS,
+// or a udp://, tcp://, tls:// or https:// URL
+func ValidUpstream(upstream string) error {
+	if !strings.Contains(upstream, "://") {
+		host := upstream
+		if h, port, err := net.SplitHostPort(upstream); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return fmt.Errorf("invalid port in '%s'", upstream)
+			}
+			host = h
+		}
+		// a bare IPv6 address is fine, anything else with
+		// colons or brackets is a mangled address
+		if host == "" || net.ParseIP(host) == nil && strings.ContainsAny(host, ":[]/") {
+			return fmt.Errorf("invalid upstream '%s'", upstream)
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls", "https":
+	default:
+		return fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("missing host in '%s'", upstream)
+	}
+
+	return nil
+}
+
+func (l *Listener) validate(name string, https bool) []error {
+	var errs []error
+
+	if l.Addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("%s.addr: %w", name, err))
+	}
+	if _, err := os.Stat(l.CertFile); err != nil {
+		errs = append(errs, fmt.Errorf("%s.cert_file: %w", name, err))
+	}
+	if _, err := os.Stat(l.KeyFile); err != nil {
+		errs = append(errs, fmt.Errorf("%s.key_file: %w", name, err))
+	}
+	if https && !strings.HasPrefix(l.Path, "/") {
+		errs = append(errs, fmt.Errorf("%s.path: must start with /", name))
+	}
+
+	return errs
+}
+
+func (c *Config) load(path string, explicit bool) error {
+	_, err := toml.DecodeFile(path, c)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		log.Printf("config file %s not found, using defaults", path)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if len(c.Interfaces) == 0 {
+		errs = append(errs, errors.New("interfaces: must not be empty"))
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.Interfaces {
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("interfaces: %s: listed more than once", name))
+			continue
+		}
+		seen[name] = true
+
+		if _, err := net.InterfaceByName(name); err != nil {
+			errs = append(errs, fmt.Errorf("interfaces: %s: %w", name, err))
+		}
+	}
+
+	if c.Database.Dsn == "" {
+		errs = append(errs, errors.New("database.dsn: must not be empty"))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Dns.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("dns.addr: %w", err))
+	}
+	if _, err := os.Stat(c.Dns.ResolvConf); err != nil && len(c.Dns.Upstream.Servers) == 0 {
+		errs = append(errs, fmt.Errorf("dns.resolv_conf: %w", err))
+	}
+	if !filepath.IsAbs(c.Dns.ListDir) {
+		errs = append(errs, errors.New("dns.list_dir: must be an absolute path"))
+	}
+	if err := ValidBlockMode(c.Dns.BlockMode); err != nil {
+		errs = append(errs, fmt.Errorf("dns.block_mode: %w", err))
+	}
+	if c.Dns.BlockMode == BlockSinkhole && c.Dns.SinkholeIPv4 == "" && c.Dns.SinkholeIPv6 == "" {
+		errs = append(errs, errors.New("dns.block_mode: sinkhole needs sinkhole_ipv4 or sinkhole_ipv6"))
+	}
+	if c.Dns.SinkholeIPv4 != "" {
+		if err := validIP(c.Dns.SinkholeIPv4, true); err != nil {
+			errs = append(errs, fmt.Errorf("dns.sinkhole_ipv4: %w", err))
+		}
+	}
+	if c.Dns.SinkholeIPv6 != "" {
+		if err := validIP(c.Dns.SinkholeIPv6, false); err != nil {
+			errs = append(errs, fmt.Errorf("dns.sinkhole_ipv6: %w", err))
+		}
+	}
+
+	if c.Dns.Cache.Size < 0 {
+		errs = append(errs, errors.New("dns.cache.size: must not be negative"))
+	}
+	if c.Dns.Cache.MaxTtl <= 0 {
+		errs = append(errs, errors.New("dns.cache.max_ttl: must be positive"))
+	}
+	if c.Dns.Cache.MaxNegativeTtl < 0 {
+		errs = append(errs, errors.New("dns.cache.max_negative_ttl: must not be negative"))
+	}
+
+	for _, upstream := range c.Dns.Upstream.Servers {
+		if err := ValidUpstream(upstream); err != nil {
+			errs = append(errs, fmt.Errorf("dns.upstream.servers: %w", err))
+		}
+	}
+	if err := ValidStrategy(c.Dns.Upstream.Strategy); err != nil {
+		errs = append(errs, fmt.Errorf("dns.upstream.strategy: %w", err))
+	}
+	if c.Dns.Upstream.Timeout <= 0 {
+		errs = append(errs, errors.New("dns.upstream.timeout: must be positive"))
+	}
+
+	if c.Dns.Log.Retention < 0 {
+		errs = append(errs, errors.New("dns.log.retention: must not be negative"))
+	}
+
+	if c.Usage.Flows.Retention < 0 {
+		errs = append(errs, errors.New("usage.flows.retention: must not be negative"))
+	}
+
+	errs = append(errs, c.Dns.Tls.validate("dns.tls", false)...)
+	errs = append(errs, c.Dns.Https.validate("dns.https", true)...)
+
+	if c.Api.SockPath == "" {
+		errs = append(errs, errors.New("api.sock_path: must not be empty"))
+	}
+	if c.Api.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("api.idle_timeout: must be positive"))
+	}
+	if c.Api.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("api.write_timeout: must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
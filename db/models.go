@@ -5,21 +5,137 @@
 package db
 
 import (
+	"net/netip"
+
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type Cidrblacklist struct {
+	Prefix netip.Prefix
+}
+
+type Device struct {
+	Hardwareaddr int64
+	Name         string
+	Tags         []string
+	Hostname     string
+	Addrs        []netip.Addr
+	Firstseen    pgtype.Timestamp
+	Lastseen     pgtype.Timestamp
+}
+
+type Devicegroup struct {
+	Name         string
+	Hardwareaddr int64
+}
+
 type Dnsblacklist struct {
-	Name string
+	Name      string
+	Exact     bool
+	Mode      string
+	Expiresat pgtype.Timestamp
+}
+
+type Dnslist struct {
+	Name      string
+	Path      string
+	Format    string
+	Mode      string
+	Updatedat pgtype.Timestamp
+}
+
+type Dnslistentry struct {
+	Listname string
+	Name     string
+	Exact    bool
+}
+
+type Dnslog struct {
+	Time         pgtype.Timestamp
+	Client       netip.Addr
+	Hardwareaddr pgtype.Int8
+	Name         string
+	Type         string
+	Rcode        string
+	Blocked      bool
+	Upstream     string
+	Latency      int64
+}
+
+type Dnspolicy struct {
+	Listname     string
+	Hardwareaddr pgtype.Int8
+	Groupname    pgtype.Text
+}
+
+type Flow struct {
+	Hardwareaddr   int64
+	Starttime      pgtype.Timestamp
+	Stoptime       pgtype.Timestamp
+	Remote         netip.Addr
+	Remoteport     int32
+	Proto          int16
+	Ingress        int64
+	Egress         int64
+	Ingresspackets int64
+	Egresspackets  int64
+}
+
+type Macallowlist struct {
+	Hardwareaddr int64
 }
 
 type Macblacklist struct {
 	Hardwareaddr int64
+	Expiresat    pgtype.Timestamp
 }
 
-type Usage struct {
+type Quota struct {
+	Hardwareaddr int64
+	Bytes        int64
+	Period       string
+	Blockedat    pgtype.Timestamp
+}
+
+type Ratelimit struct {
 	Hardwareaddr int64
-	Starttime    pgtype.Timestamp
-	Stoptime     pgtype.Timestamp
-	Egress       int64
 	Ingress      int64
+	Egress       int64
+}
+
+type Schedule struct {
+	Name          string
+	Days          int32
+	Starttime     pgtype.Time
+	Stoptime      pgtype.Time
+	Hardwareaddrs []int64
+	Domains       []string
+}
+
+type Setting struct {
+	Name  string
+	Value string
+}
+
+type Usage struct {
+	Hardwareaddr   int64
+	Iface          string
+	Starttime      pgtype.Timestamp
+	Stoptime       pgtype.Timestamp
+	Egress         int64
+	Ingress        int64
+	Ingresspackets int64
+	Egresspackets  int64
+	Ingressipv4    int64
+	Ingressipv6    int64
+	Ingresstcp     int64
+	Ingressudp     int64
+	Ingressicmp    int64
+	Ingressother   int64
+	Egressipv4     int64
+	Egressipv6     int64
+	Egresstcp      int64
+	Egressudp      int64
+	Egressicmp     int64
+	Egressother    int64
 }
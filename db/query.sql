@@ -1,19 +1,91 @@
 -- name: EnterUsage :exec
 INSERT INTO Usage (
-  HardwareAddr, StartTime, StopTime, Egress, Ingress
+  HardwareAddr, Iface, StartTime, StopTime, Egress, Ingress,
+  IngressPackets, EgressPackets,
+  IngressIPv4, IngressIPv6, IngressTcp, IngressUdp, IngressIcmp, IngressOther,
+  EgressIPv4, EgressIPv6, EgressTcp, EgressUdp, EgressIcmp, EgressOther
 ) VALUES (
-  $1, $2, $3, $4, $5
+  $1, $2, $3, $4, $5, $6,
+  $7, $8,
+  $9, $10, $11, $12, $13, $14,
+  $15, $16, $17, $18, $19, $20
 );
 
 -- name: GetUsage :one
 SELECT SUM(Ingress) AS Ingress, SUM(Egress) AS Egress FROM Usage;
 
+-- name: GetUsageByIface :many
+SELECT Iface, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets,
+  SUM(IngressIPv4)::bigint AS IngressIPv4,
+  SUM(IngressIPv6)::bigint AS IngressIPv6,
+  SUM(IngressTcp)::bigint AS IngressTcp,
+  SUM(IngressUdp)::bigint AS IngressUdp,
+  SUM(IngressIcmp)::bigint AS IngressIcmp,
+  SUM(IngressOther)::bigint AS IngressOther,
+  SUM(EgressIPv4)::bigint AS EgressIPv4,
+  SUM(EgressIPv6)::bigint AS EgressIPv6,
+  SUM(EgressTcp)::bigint AS EgressTcp,
+  SUM(EgressUdp)::bigint AS EgressUdp,
+  SUM(EgressIcmp)::bigint AS EgressIcmp,
+  SUM(EgressOther)::bigint AS EgressOther
+FROM Usage
+GROUP BY Iface;
+
+-- name: GetUsageByMac :many
+SELECT HardwareAddr, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress
+FROM Usage
+WHERE StopTime >= sqlc.arg(start_time) AND StartTime < sqlc.arg(stop_time)
+GROUP BY HardwareAddr;
+
+-- name: GetUsageHistory :many
+SELECT HardwareAddr, date_trunc(sqlc.arg(period)::text, StartTime)::timestamp AS Bucket,
+  SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress
+FROM Usage
+WHERE StopTime >= sqlc.arg(start_time) AND StartTime < sqlc.arg(stop_time)
+GROUP BY HardwareAddr, Bucket
+ORDER BY Bucket;
+
+-- name: EnterFlow :copyfrom
+INSERT INTO Flow (
+  HardwareAddr, StartTime, StopTime, Remote, RemotePort, Proto,
+  Ingress, Egress, IngressPackets, EgressPackets
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+);
+
+-- name: DeleteFlow :exec
+DELETE FROM Flow
+WHERE StopTime < $1;
+
+-- name: GetTopTalkers :many
+SELECT HardwareAddr, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets
+FROM Flow
+WHERE StopTime >= sqlc.arg(start_time) AND StartTime < sqlc.arg(stop_time)
+  AND (sqlc.narg(hardware_addr)::bigint IS NULL OR HardwareAddr = sqlc.narg(hardware_addr))
+GROUP BY HardwareAddr
+ORDER BY SUM(Ingress + Egress) DESC
+LIMIT sqlc.arg(max_rows);
+
+-- name: GetTopDestinations :many
+SELECT Remote, RemotePort, Proto, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets
+FROM Flow
+WHERE StopTime >= sqlc.arg(start_time) AND StartTime < sqlc.arg(stop_time)
+  AND (sqlc.narg(hardware_addr)::bigint IS NULL OR HardwareAddr = sqlc.narg(hardware_addr))
+GROUP BY Remote, RemotePort, Proto
+ORDER BY SUM(Ingress + Egress) DESC
+LIMIT sqlc.arg(max_rows);
+
 -- name: EnterDnsBlackList :exec
 INSERT INTO DnsBlackList (
-  Name
+  Name, Exact, Mode, ExpiresAt
 ) VALUES (
-  $1
-);
+  $1, $2, $3, $4
+)
+ON CONFLICT (Name) DO UPDATE
+SET Exact = EXCLUDED.Exact, Mode = EXCLUDED.Mode, ExpiresAt = EXCLUDED.ExpiresAt;
 
 -- name: DeleteDnsBlackList :exec
 DELETE FROM DnsBlackList
@@ -22,12 +94,118 @@ WHERE Name = $1;
 -- name: GetDnsBlackList :many
 SELECT * FROM DnsBlackList;
 
+-- name: EnterDnsList :exec
+INSERT INTO DnsList (
+  Name, Path, Format, Mode, UpdatedAt
+) VALUES (
+  $1, $2, $3, $4, $5
+)
+ON CONFLICT (Name) DO UPDATE
+SET Path = EXCLUDED.Path, Format = EXCLUDED.Format, Mode = EXCLUDED.Mode,
+  UpdatedAt = EXCLUDED.UpdatedAt;
+
+-- name: DeleteDnsList :exec
+DELETE FROM DnsList
+WHERE Name = $1;
+
+-- name: GetDnsList :one
+SELECT * FROM DnsList
+WHERE Name = $1;
+
+-- name: GetDnsLists :many
+SELECT * FROM DnsList;
+
+-- name: EnterDnsListEntries :copyfrom
+INSERT INTO DnsListEntry (
+  ListName, Name, Exact
+) VALUES (
+  $1, $2, $3
+);
+
+-- name: DeleteDnsListEntries :exec
+DELETE FROM DnsListEntry
+WHERE ListName = $1;
+
+-- name: GetDnsListEntries :many
+SELECT * FROM DnsListEntry;
+
+-- name: EnterDevice :exec
+INSERT INTO Device (
+  HardwareAddr, Name, Tags, Hostname, Addrs, FirstSeen, LastSeen
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Name = EXCLUDED.Name, Tags = EXCLUDED.Tags, Hostname = EXCLUDED.Hostname,
+  Addrs = EXCLUDED.Addrs, FirstSeen = EXCLUDED.FirstSeen, LastSeen = EXCLUDED.LastSeen;
+
+-- name: DeleteDevice :exec
+DELETE FROM Device
+WHERE HardwareAddr = $1;
+
+-- name: GetDevices :many
+SELECT * FROM Device;
+
+-- name: EnterDeviceGroup :exec
+INSERT INTO DeviceGroup (
+  Name, HardwareAddr
+) VALUES (
+  $1, $2
+)
+ON CONFLICT DO NOTHING;
+
+-- name: DeleteDeviceGroup :exec
+DELETE FROM DeviceGroup
+WHERE Name = $1 AND HardwareAddr = $2;
+
+-- name: GetDeviceGroups :many
+SELECT * FROM DeviceGroup;
+
+-- name: EnterDnsPolicy :exec
+INSERT INTO DnsPolicy (
+  ListName, HardwareAddr, GroupName
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT DO NOTHING;
+
+-- name: DeleteDnsPolicy :exec
+DELETE FROM DnsPolicy
+WHERE ListName = $1 AND HardwareAddr IS NOT DISTINCT FROM $2
+  AND GroupName IS NOT DISTINCT FROM $3;
+
+-- name: GetDnsPolicies :many
+SELECT * FROM DnsPolicy;
+
+-- name: EnterDnsLog :copyfrom
+INSERT INTO DnsLog (
+  Time, Client, HardwareAddr, Name, Type, Rcode, Blocked, Upstream, Latency
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7, $8, $9
+);
+
+-- name: DeleteDnsLog :exec
+DELETE FROM DnsLog
+WHERE Time < $1;
+
+-- name: GetDnsLog :many
+SELECT * FROM DnsLog
+WHERE Time >= sqlc.arg(start_time) AND Time < sqlc.arg(stop_time)
+  AND (sqlc.narg(client)::inet IS NULL OR Client = sqlc.narg(client))
+  AND (sqlc.narg(hardware_addr)::bigint IS NULL OR HardwareAddr = sqlc.narg(hardware_addr))
+  AND (sqlc.narg(name)::text IS NULL OR Name = sqlc.narg(name)
+    OR right(Name, length(sqlc.narg(name)) + 1) = '.' || sqlc.narg(name))
+ORDER BY Time DESC
+LIMIT sqlc.arg(max_rows);
+
 -- name: EnterMacBlackList :exec
 INSERT INTO MacBlackList (
-  HardwareAddr
+  HardwareAddr, ExpiresAt
 ) VALUES (
-  $1
-);
+  $1, $2
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET ExpiresAt = EXCLUDED.ExpiresAt;
 
 -- name: DeleteMacBlackList :exec
 DELETE FROM MacBlackList
@@ -35,3 +213,114 @@ WHERE HardwareAddr = $1;
 
 -- name: GetMacBlackList :many
 SELECT * FROM MacBlackList;
+
+-- name: EnterMacAllowList :exec
+INSERT INTO MacAllowList (
+  HardwareAddr
+) VALUES (
+  $1
+)
+ON CONFLICT (HardwareAddr) DO NOTHING;
+
+-- name: DeleteMacAllowList :exec
+DELETE FROM MacAllowList
+WHERE HardwareAddr = $1;
+
+-- name: GetMacAllowList :many
+SELECT * FROM MacAllowList;
+
+-- name: EnterSetting :exec
+INSERT INTO Setting (
+  Name, Value
+) VALUES (
+  $1, $2
+)
+ON CONFLICT (Name) DO UPDATE
+SET Value = EXCLUDED.Value;
+
+-- name: GetSetting :one
+SELECT Value FROM Setting
+WHERE Name = $1;
+
+-- name: EnterCidrBlackList :exec
+INSERT INTO CidrBlackList (
+  Prefix
+) VALUES (
+  $1
+)
+ON CONFLICT (Prefix) DO NOTHING;
+
+-- name: DeleteCidrBlackList :exec
+DELETE FROM CidrBlackList
+WHERE Prefix = $1;
+
+-- name: GetCidrBlackList :many
+SELECT * FROM CidrBlackList;
+
+-- name: EnterQuota :exec
+INSERT INTO Quota (
+  HardwareAddr, Bytes, Period
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Bytes = EXCLUDED.Bytes, Period = EXCLUDED.Period;
+
+-- name: DeleteQuota :exec
+DELETE FROM Quota
+WHERE HardwareAddr = $1;
+
+-- name: GetQuotas :many
+SELECT * FROM Quota;
+
+-- name: SetQuotaBlockedAt :exec
+UPDATE Quota
+SET BlockedAt = $2
+WHERE HardwareAddr = $1;
+
+-- name: GetQuotaUsage :many
+-- rows that started before start_time only count the share of
+-- their traffic after it, as if it was spread evenly over the row
+SELECT HardwareAddr, SUM(CASE
+    WHEN StartTime >= sqlc.arg(start_time)::timestamp OR StopTime <= StartTime
+    THEN Ingress + Egress
+    ELSE (Ingress + Egress) * EXTRACT(EPOCH FROM StopTime - sqlc.arg(start_time)::timestamp)
+      / EXTRACT(EPOCH FROM StopTime - StartTime)
+  END)::bigint AS Bytes
+FROM Usage
+WHERE StopTime > sqlc.arg(start_time)::timestamp
+GROUP BY HardwareAddr;
+
+-- name: EnterRateLimit :exec
+INSERT INTO RateLimit (
+  HardwareAddr, Ingress, Egress
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Ingress = EXCLUDED.Ingress, Egress = EXCLUDED.Egress;
+
+-- name: DeleteRateLimit :exec
+DELETE FROM RateLimit
+WHERE HardwareAddr = $1;
+
+-- name: GetRateLimits :many
+SELECT * FROM RateLimit;
+
+-- name: EnterSchedule :exec
+INSERT INTO Schedule (
+  Name, Days, StartTime, StopTime, HardwareAddrs, Domains
+) VALUES (
+  $1, $2, $3, $4, $5, $6
+)
+ON CONFLICT (Name) DO UPDATE
+SET Days = EXCLUDED.Days, StartTime = EXCLUDED.StartTime,
+  StopTime = EXCLUDED.StopTime, HardwareAddrs = EXCLUDED.HardwareAddrs,
+  Domains = EXCLUDED.Domains;
+
+-- name: DeleteSchedule :exec
+DELETE FROM Schedule
+WHERE Name = $1;
+
+-- name: GetSchedules :many
+SELECT * FROM Schedule;
@@ -7,10 +7,46 @@ package db
 
 import (
 	"context"
+	"net/netip"
 
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const deleteCidrBlackList = `-- name: DeleteCidrBlackList :exec
+DELETE FROM CidrBlackList
+WHERE Prefix = $1
+`
+
+func (q *Queries) DeleteCidrBlackList(ctx context.Context, prefix netip.Prefix) error {
+	_, err := q.db.Exec(ctx, deleteCidrBlackList, prefix)
+	return err
+}
+
+const deleteDevice = `-- name: DeleteDevice :exec
+DELETE FROM Device
+WHERE HardwareAddr = $1
+`
+
+func (q *Queries) DeleteDevice(ctx context.Context, hardwareaddr int64) error {
+	_, err := q.db.Exec(ctx, deleteDevice, hardwareaddr)
+	return err
+}
+
+const deleteDeviceGroup = `-- name: DeleteDeviceGroup :exec
+DELETE FROM DeviceGroup
+WHERE Name = $1 AND HardwareAddr = $2
+`
+
+type DeleteDeviceGroupParams struct {
+	Name         string
+	Hardwareaddr int64
+}
+
+func (q *Queries) DeleteDeviceGroup(ctx context.Context, arg DeleteDeviceGroupParams) error {
+	_, err := q.db.Exec(ctx, deleteDeviceGroup, arg.Name, arg.Hardwareaddr)
+	return err
+}
+
 const deleteDnsBlackList = `-- name: DeleteDnsBlackList :exec
 DELETE FROM DnsBlackList
 WHERE Name = $1
@@ -21,6 +57,73 @@ func (q *Queries) DeleteDnsBlackList(ctx context.Context, name string) error {
 	return err
 }
 
+const deleteDnsList = `-- name: DeleteDnsList :exec
+DELETE FROM DnsList
+WHERE Name = $1
+`
+
+func (q *Queries) DeleteDnsList(ctx context.Context, name string) error {
+	_, err := q.db.Exec(ctx, deleteDnsList, name)
+	return err
+}
+
+const deleteDnsListEntries = `-- name: DeleteDnsListEntries :exec
+DELETE FROM DnsListEntry
+WHERE ListName = $1
+`
+
+func (q *Queries) DeleteDnsListEntries(ctx context.Context, listname string) error {
+	_, err := q.db.Exec(ctx, deleteDnsListEntries, listname)
+	return err
+}
+
+const deleteDnsLog = `-- name: DeleteDnsLog :exec
+DELETE FROM DnsLog
+WHERE Time < $1
+`
+
+func (q *Queries) DeleteDnsLog(ctx context.Context, time pgtype.Timestamp) error {
+	_, err := q.db.Exec(ctx, deleteDnsLog, time)
+	return err
+}
+
+const deleteDnsPolicy = `-- name: DeleteDnsPolicy :exec
+DELETE FROM DnsPolicy
+WHERE ListName = $1 AND HardwareAddr IS NOT DISTINCT FROM $2
+  AND GroupName IS NOT DISTINCT FROM $3
+`
+
+type DeleteDnsPolicyParams struct {
+	Listname     string
+	Hardwareaddr pgtype.Int8
+	Groupname    pgtype.Text
+}
+
+func (q *Queries) DeleteDnsPolicy(ctx context.Context, arg DeleteDnsPolicyParams) error {
+	_, err := q.db.Exec(ctx, deleteDnsPolicy, arg.Listname, arg.Hardwareaddr, arg.Groupname)
+	return err
+}
+
+const deleteFlow = `-- name: DeleteFlow :exec
+DELETE FROM Flow
+WHERE StopTime < $1
+`
+
+func (q *Queries) DeleteFlow(ctx context.Context, stoptime pgtype.Timestamp) error {
+	_, err := q.db.Exec(ctx, deleteFlow, stoptime)
+	return err
+}
+
+const deleteMacAllowList = `-- name: DeleteMacAllowList :exec
+DELETE FROM MacAllowList
+WHERE HardwareAddr = $1
+`
+
+func (q *Queries) DeleteMacAllowList(ctx context.Context, hardwareaddr int64) error {
+	_, err := q.db.Exec(ctx, deleteMacAllowList, hardwareaddr)
+	return err
+}
+
 const deleteMacBlackList = `-- name: DeleteMacBlackList :exec
 DELETE FROM MacBlackList
 WHERE HardwareAddr = $1
@@ -31,76 +134,420 @@ func (q *Queries) DeleteMacBlackList(ctx context.Context, hardwareaddr int64) er
 	return err
 }
 
+const deleteQuota = `-- name: DeleteQuota :exec
+DELETE FROM Quota
+WHERE HardwareAddr = $1
+`
+
+func (q *Queries) DeleteQuota(ctx context.Context, hardwareaddr int64) error {
+	_, err := q.db.Exec(ctx, deleteQuota, hardwareaddr)
+	return err
+}
+
+const deleteRateLimit = `-- name: DeleteRateLimit :exec
+DELETE FROM RateLimit
+WHERE HardwareAddr = $1
+`
+
+func (q *Queries) DeleteRateLimit(ctx context.Context, hardwareaddr int64) error {
+	_, err := q.db.Exec(ctx, deleteRateLimit, hardwareaddr)
+	return err
+}
+
+const deleteSchedule = `-- name: DeleteSchedule :exec
+DELETE FROM Schedule
+WHERE Name = $1
+`
+
+func (q *Queries) DeleteSchedule(ctx context.Context, name string) error {
+	_, err := q.db.Exec(ctx, deleteSchedule, name)
+	return err
+}
+
+const enterCidrBlackList = `-- name: EnterCidrBlackList :exec
+INSERT INTO CidrBlackList (
+  Prefix
+) VALUES (
+  $1
+)
+ON CONFLICT (Prefix) DO NOTHING
+`
+
+func (q *Queries) EnterCidrBlackList(ctx context.Context, prefix netip.Prefix) error {
+	_, err := q.db.Exec(ctx, enterCidrBlackList, prefix)
+	return err
+}
+
+const enterDevice = `-- name: EnterDevice :exec
+INSERT INTO Device (
+  HardwareAddr, Name, Tags, Hostname, Addrs, FirstSeen, LastSeen
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Name = EXCLUDED.Name, Tags = EXCLUDED.Tags, Hostname = EXCLUDED.Hostname,
+  Addrs = EXCLUDED.Addrs, FirstSeen = EXCLUDED.FirstSeen, LastSeen = EXCLUDED.LastSeen
+`
+
+type EnterDeviceParams struct {
+	Hardwareaddr int64
+	Name         string
+	Tags         []string
+	Hostname     string
+	Addrs        []netip.Addr
+	Firstseen    pgtype.Timestamp
+	Lastseen     pgtype.Timestamp
+}
+
+func (q *Queries) EnterDevice(ctx context.Context, arg EnterDeviceParams) error {
+	_, err := q.db.Exec(ctx, enterDevice,
+		arg.Hardwareaddr,
+		arg.Name,
+		arg.Tags,
+		arg.Hostname,
+		arg.Addrs,
+		arg.Firstseen,
+		arg.Lastseen,
+	)
+	return err
+}
+
+const enterDeviceGroup = `-- name: EnterDeviceGroup :exec
+INSERT INTO DeviceGroup (
+  Name, HardwareAddr
+) VALUES (
+  $1, $2
+)
+ON CONFLICT DO NOTHING
+`
+
+type EnterDeviceGroupParams struct {
+	Name         string
+	Hardwareaddr int64
+}
+
+func (q *Queries) EnterDeviceGroup(ctx context.Context, arg EnterDeviceGroupParams) error {
+	_, err := q.db.Exec(ctx, enterDeviceGroup, arg.Name, arg.Hardwareaddr)
+	return err
+}
+
 const enterDnsBlackList = `-- name: EnterDnsBlackList :exec
 INSERT INTO DnsBlackList (
-  Name
+  Name, Exact, Mode, ExpiresAt
+) VALUES (
+  $1, $2, $3, $4
+)
+ON CONFLICT (Name) DO UPDATE
+SET Exact = EXCLUDED.Exact, Mode = EXCLUDED.Mode, ExpiresAt = EXCLUDED.ExpiresAt
+`
+
+type EnterDnsBlackListParams struct {
+	Name      string
+	Exact     bool
+	Mode      string
+	Expiresat pgtype.Timestamp
+}
+
+func (q *Queries) EnterDnsBlackList(ctx context.Context, arg EnterDnsBlackListParams) error {
+	_, err := q.db.Exec(ctx, enterDnsBlackList,
+		arg.Name,
+		arg.Exact,
+		arg.Mode,
+		arg.Expiresat,
+	)
+	return err
+}
+
+const enterDnsList = `-- name: EnterDnsList :exec
+INSERT INTO DnsList (
+  Name, Path, Format, Mode, UpdatedAt
+) VALUES (
+  $1, $2, $3, $4, $5
+)
+ON CONFLICT (Name) DO UPDATE
+SET Path = EXCLUDED.Path, Format = EXCLUDED.Format, Mode = EXCLUDED.Mode,
+  UpdatedAt = EXCLUDED.UpdatedAt
+`
+
+type EnterDnsListParams struct {
+	Name      string
+	Path      string
+	Format    string
+	Mode      string
+	Updatedat pgtype.Timestamp
+}
+
+func (q *Queries) EnterDnsList(ctx context.Context, arg EnterDnsListParams) error {
+	_, err := q.db.Exec(ctx, enterDnsList,
+		arg.Name,
+		arg.Path,
+		arg.Format,
+		arg.Mode,
+		arg.Updatedat,
+	)
+	return err
+}
+
+type EnterDnsListEntriesParams struct {
+	Listname string
+	Name     string
+	Exact    bool
+}
+
+type EnterDnsLogParams struct {
+	Time         pgtype.Timestamp
+	Client       netip.Addr
+	Hardwareaddr pgtype.Int8
+	Name         string
+	Type         string
+	Rcode        string
+	Blocked      bool
+	Upstream     string
+	Latency      int64
+}
+
+const enterDnsPolicy = `-- name: EnterDnsPolicy :exec
+INSERT INTO DnsPolicy (
+  ListName, HardwareAddr, GroupName
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT DO NOTHING
+`
+
+type EnterDnsPolicyParams struct {
+	Listname     string
+	Hardwareaddr pgtype.Int8
+	Groupname    pgtype.Text
+}
+
+func (q *Queries) EnterDnsPolicy(ctx context.Context, arg EnterDnsPolicyParams) error {
+	_, err := q.db.Exec(ctx, enterDnsPolicy, arg.Listname, arg.Hardwareaddr, arg.Groupname)
+	return err
+}
+
+type EnterFlowParams struct {
+	Hardwareaddr   int64
+	Starttime      pgtype.Timestamp
+	Stoptime       pgtype.Timestamp
+	Remote         netip.Addr
+	Remoteport     int32
+	Proto          int16
+	Ingress        int64
+	Egress         int64
+	Ingresspackets int64
+	Egresspackets  int64
+}
+
+const enterMacAllowList = `-- name: EnterMacAllowList :exec
+INSERT INTO MacAllowList (
+  HardwareAddr
 ) VALUES (
   $1
 )
+ON CONFLICT (HardwareAddr) DO NOTHING
 `
 
-func (q *Queries) EnterDnsBlackList(ctx context.Context, name string) error {
-	_, err := q.db.Exec(ctx, enterDnsBlackList, name)
+func (q *Queries) EnterMacAllowList(ctx context.Context, hardwareaddr int64) error {
+	_, err := q.db.Exec(ctx, enterMacAllowList, hardwareaddr)
 	return err
 }
 
 const enterMacBlackList = `-- name: EnterMacBlackList :exec
 INSERT INTO MacBlackList (
-  HardwareAddr
+  HardwareAddr, ExpiresAt
 ) VALUES (
-  $1
+  $1, $2
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET ExpiresAt = EXCLUDED.ExpiresAt
+`
+
+type EnterMacBlackListParams struct {
+	Hardwareaddr int64
+	Expiresat    pgtype.Timestamp
+}
+
+func (q *Queries) EnterMacBlackList(ctx context.Context, arg EnterMacBlackListParams) error {
+	_, err := q.db.Exec(ctx, enterMacBlackList, arg.Hardwareaddr, arg.Expiresat)
+	return err
+}
+
+const enterQuota = `-- name: EnterQuota :exec
+INSERT INTO Quota (
+  HardwareAddr, Bytes, Period
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Bytes = EXCLUDED.Bytes, Period = EXCLUDED.Period
+`
+
+type EnterQuotaParams struct {
+	Hardwareaddr int64
+	Bytes        int64
+	Period       string
+}
+
+func (q *Queries) EnterQuota(ctx context.Context, arg EnterQuotaParams) error {
+	_, err := q.db.Exec(ctx, enterQuota, arg.Hardwareaddr, arg.Bytes, arg.Period)
+	return err
+}
+
+const enterRateLimit = `-- name: EnterRateLimit :exec
+INSERT INTO RateLimit (
+  HardwareAddr, Ingress, Egress
+) VALUES (
+  $1, $2, $3
 )
+ON CONFLICT (HardwareAddr) DO UPDATE
+SET Ingress = EXCLUDED.Ingress, Egress = EXCLUDED.Egress
 `
 
-func (q *Queries) EnterMacBlackList(ctx context.Context, hardwareaddr int64) error {
-	_, err := q.db.Exec(ctx, enterMacBlackList, hardwareaddr)
+type EnterRateLimitParams struct {
+	Hardwareaddr int64
+	Ingress      int64
+	Egress       int64
+}
+
+func (q *Queries) EnterRateLimit(ctx context.Context, arg EnterRateLimitParams) error {
+	_, err := q.db.Exec(ctx, enterRateLimit, arg.Hardwareaddr, arg.Ingress, arg.Egress)
+	return err
+}
+
+const enterSchedule = `-- name: EnterSchedule :exec
+INSERT INTO Schedule (
+  Name, Days, StartTime, StopTime, HardwareAddrs, Domains
+) VALUES (
+  $1, $2, $3, $4, $5, $6
+)
+ON CONFLICT (Name) DO UPDATE
+SET Days = EXCLUDED.Days, StartTime = EXCLUDED.StartTime,
+  StopTime = EXCLUDED.StopTime, HardwareAddrs = EXCLUDED.HardwareAddrs,
+  Domains = EXCLUDED.Domains
+`
+
+type EnterScheduleParams struct {
+	Name          string
+	Days          int32
+	Starttime     pgtype.Time
+	Stoptime      pgtype.Time
+	Hardwareaddrs []int64
+	Domains       []string
+}
+
+func (q *Queries) EnterSchedule(ctx context.Context, arg EnterScheduleParams) error {
+	_, err := q.db.Exec(ctx, enterSchedule,
+		arg.Name,
+		arg.Days,
+		arg.Starttime,
+		arg.Stoptime,
+		arg.Hardwareaddrs,
+		arg.Domains,
+	)
+	return err
+}
+
+const enterSetting = `-- name: EnterSetting :exec
+INSERT INTO Setting (
+  Name, Value
+) VALUES (
+  $1, $2
+)
+ON CONFLICT (Name) DO UPDATE
+SET Value = EXCLUDED.Value
+`
+
+type EnterSettingParams struct {
+	Name  string
+	Value string
+}
+
+func (q *Queries) EnterSetting(ctx context.Context, arg EnterSettingParams) error {
+	_, err := q.db.Exec(ctx, enterSetting, arg.Name, arg.Value)
 	return err
 }
 
 const enterUsage = `-- name: EnterUsage :exec
 INSERT INTO Usage (
-  HardwareAddr, StartTime, StopTime, Egress, Ingress
+  HardwareAddr, Iface, StartTime, StopTime, Egress, Ingress,
+  IngressPackets, EgressPackets,
+  IngressIPv4, IngressIPv6, IngressTcp, IngressUdp, IngressIcmp, IngressOther,
+  EgressIPv4, EgressIPv6, EgressTcp, EgressUdp, EgressIcmp, EgressOther
 ) VALUES (
-  $1, $2, $3, $4, $5
+  $1, $2, $3, $4, $5, $6,
+  $7, $8,
+  $9, $10, $11, $12, $13, $14,
+  $15, $16, $17, $18, $19, $20
 )
 `
 
 type EnterUsageParams struct {
-	Hardwareaddr int64
-	Starttime    pgtype.Timestamp
-	Stoptime     pgtype.Timestamp
-	Egress       int64
-	Ingress      int64
+	Hardwareaddr   int64
+	Iface          string
+	Starttime      pgtype.Timestamp
+	Stoptime       pgtype.Timestamp
+	Egress         int64
+	Ingress        int64
+	Ingresspackets int64
+	Egresspackets  int64
+	Ingressipv4    int64
+	Ingressipv6    int64
+	Ingresstcp     int64
+	Ingressudp     int64
+	Ingressicmp    int64
+	Ingressother   int64
+	Egressipv4     int64
+	Egressipv6     int64
+	Egresstcp      int64
+	Egressudp      int64
+	Egressicmp     int64
+	Egressother    int64
 }
 
 func (q *Queries) EnterUsage(ctx context.Context, arg EnterUsageParams) error {
 	_, err := q.db.Exec(ctx, enterUsage,
 		arg.Hardwareaddr,
+		arg.Iface,
 		arg.Starttime,
 		arg.Stoptime,
 		arg.Egress,
 		arg.Ingress,
+		arg.Ingresspackets,
+		arg.Egresspackets,
+		arg.Ingressipv4,
+		arg.Ingressipv6,
+		arg.Ingresstcp,
+		arg.Ingressudp,
+		arg.Ingressicmp,
+		arg.Ingressother,
+		arg.Egressipv4,
+		arg.Egressipv6,
+		arg.Egresstcp,
+		arg.Egressudp,
+		arg.Egressicmp,
+		arg.Egressother,
 	)
 	return err
 }
 
-const getDnsBlackList = `-- name: GetDnsBlackList :many
-SELECT name FROM DnsBlackList
+const getCidrBlackList = `-- name: GetCidrBlackList :many
+SELECT prefix FROM CidrBlackList
 `
 
-func (q *Queries) GetDnsBlackList(ctx context.Context) ([]string, error) {
-	rows, err := q.db.Query(ctx, getDnsBlackList)
+func (q *Queries) GetCidrBlackList(ctx context.Context) ([]netip.Prefix, error) {
+	rows, err := q.db.Query(ctx, getCidrBlackList)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []netip.Prefix
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
+		var prefix netip.Prefix
+		if err := rows.Scan(&prefix); err != nil {
 			return nil, err
 		}
-		items = append(items, name)
+		items = append(items, prefix)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -108,23 +555,23 @@ func (q *Queries) GetDnsBlackList(ctx context.Context) ([]string, error) {
 	return items, nil
 }
 
-const getMacBlackList = `-- name: GetMacBlackList :many
-SELECT hardwareaddr FROM MacBlackList
+const getDeviceGroups = `-- name: GetDeviceGroups :many
+SELECT name, hardwareaddr FROM DeviceGroup
 `
 
-func (q *Queries) GetMacBlackList(ctx context.Context) ([]int64, error) {
-	rows, err := q.db.Query(ctx, getMacBlackList)
+func (q *Queries) GetDeviceGroups(ctx context.Context) ([]Devicegroup, error) {
+	rows, err := q.db.Query(ctx, getDeviceGroups)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []int64
+	var items []Devicegroup
 	for rows.Next() {
-		var hardwareaddr int64
-		if err := rows.Scan(&hardwareaddr); err != nil {
+		var i Devicegroup
+		if err := rows.Scan(&i.Name, &i.Hardwareaddr); err != nil {
 			return nil, err
 		}
-		items = append(items, hardwareaddr)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -132,18 +579,711 @@ func (q *Queries) GetMacBlackList(ctx context.Context) ([]int64, error) {
 	return items, nil
 }
 
-const getUsage = `-- name: GetUsage :one
-SELECT SUM(Ingress) AS Ingress, SUM(Egress) AS Egress FROM Usage
+const getDevices = `-- name: GetDevices :many
+SELECT hardwareaddr, name, tags, hostname, addrs, firstseen, lastseen FROM Device
 `
 
-type GetUsageRow struct {
-	Ingress int64
-	Egress  int64
+func (q *Queries) GetDevices(ctx context.Context) ([]Device, error) {
+	rows, err := q.db.Query(ctx, getDevices)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Device
+	for rows.Next() {
+		var i Device
+		if err := rows.Scan(
+			&i.Hardwareaddr,
+			&i.Name,
+			&i.Tags,
+			&i.Hostname,
+			&i.Addrs,
+			&i.Firstseen,
+			&i.Lastseen,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-func (q *Queries) GetUsage(ctx context.Context) (GetUsageRow, error) {
-	row := q.db.QueryRow(ctx, getUsage)
-	var i GetUsageRow
-	err := row.Scan(&i.Ingress, &i.Egress)
+const getDnsBlackList = `-- name: GetDnsBlackList :many
+SELECT name, exact, mode, expiresat FROM DnsBlackList
+`
+
+func (q *Queries) GetDnsBlackList(ctx context.Context) ([]Dnsblacklist, error) {
+	rows, err := q.db.Query(ctx, getDnsBlackList)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dnsblacklist
+	for rows.Next() {
+		var i Dnsblacklist
+		if err := rows.Scan(
+			&i.Name,
+			&i.Exact,
+			&i.Mode,
+			&i.Expiresat,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDnsList = `-- name: GetDnsList :one
+SELECT name, path, format, mode, updatedat FROM DnsList
+WHERE Name = $1
+`
+
+func (q *Queries) GetDnsList(ctx context.Context, name string) (Dnslist, error) {
+	row := q.db.QueryRow(ctx, getDnsList, name)
+	var i Dnslist
+	err := row.Scan(
+		&i.Name,
+		&i.Path,
+		&i.Format,
+		&i.Mode,
+		&i.Updatedat,
+	)
 	return i, err
 }
+
+const getDnsListEntries = `-- name: GetDnsListEntries :many
+SELECT listname, name, exact FROM DnsListEntry
+`
+
+func (q *Queries) GetDnsListEntries(ctx context.Context) ([]Dnslistentry, error) {
+	rows, err := q.db.Query(ctx, getDnsListEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dnslistentry
+	for rows.Next() {
+		var i Dnslistentry
+		if err := rows.Scan(&i.Listname, &i.Name, &i.Exact); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDnsLists = `-- name: GetDnsLists :many
+SELECT name, path, format, mode, updatedat FROM DnsList
+`
+
+func (q *Queries) GetDnsLists(ctx context.Context) ([]Dnslist, error) {
+	rows, err := q.db.Query(ctx, getDnsLists)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dnslist
+	for rows.Next() {
+		var i Dnslist
+		if err := rows.Scan(
+			&i.Name,
+			&i.Path,
+			&i.Format,
+			&i.Mode,
+			&i.Updatedat,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDnsLog = `-- name: GetDnsLog :many
+SELECT time, client, hardwareaddr, name, type, rcode, blocked, upstream, latency FROM DnsLog
+WHERE Time >= $1 AND Time < $2
+  AND ($3::inet IS NULL OR Client = $3)
+  AND ($4::bigint IS NULL OR HardwareAddr = $4)
+  AND ($5::text IS NULL OR Name = $5
+    OR right(Name, length($5) + 1) = '.' || $5)
+ORDER BY Time DESC
+LIMIT $6
+`
+
+type GetDnsLogParams struct {
+	StartTime    pgtype.Timestamp
+	StopTime     pgtype.Timestamp
+	Client       *netip.Addr
+	HardwareAddr pgtype.Int8
+	Name         pgtype.Text
+	MaxRows      int32
+}
+
+func (q *Queries) GetDnsLog(ctx context.Context, arg GetDnsLogParams) ([]Dnslog, error) {
+	rows, err := q.db.Query(ctx, getDnsLog,
+		arg.StartTime,
+		arg.StopTime,
+		arg.Client,
+		arg.HardwareAddr,
+		arg.Name,
+		arg.MaxRows,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dnslog
+	for rows.Next() {
+		var i Dnslog
+		if err := rows.Scan(
+			&i.Time,
+			&i.Client,
+			&i.Hardwareaddr,
+			&i.Name,
+			&i.Type,
+			&i.Rcode,
+			&i.Blocked,
+			&i.Upstream,
+			&i.Latency,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDnsPolicies = `-- name: GetDnsPolicies :many
+SELECT listname, hardwareaddr, groupname FROM DnsPolicy
+`
+
+func (q *Queries) GetDnsPolicies(ctx context.Context) ([]Dnspolicy, error) {
+	rows, err := q.db.Query(ctx, getDnsPolicies)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dnspolicy
+	for rows.Next() {
+		var i Dnspolicy
+		if err := rows.Scan(&i.Listname, &i.Hardwareaddr, &i.Groupname); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMacAllowList = `-- name: GetMacAllowList :many
+SELECT hardwareaddr FROM MacAllowList
+`
+
+func (q *Queries) GetMacAllowList(ctx context.Context) ([]int64, error) {
+	rows, err := q.db.Query(ctx, getMacAllowList)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var hardwareaddr int64
+		if err := rows.Scan(&hardwareaddr); err != nil {
+			return nil, err
+		}
+		items = append(items, hardwareaddr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMacBlackList = `-- name: GetMacBlackList :many
+SELECT hardwareaddr, expiresat FROM MacBlackList
+`
+
+func (q *Queries) GetMacBlackList(ctx context.Context) ([]Macblacklist, error) {
+	rows, err := q.db.Query(ctx, getMacBlackList)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Macblacklist
+	for rows.Next() {
+		var i Macblacklist
+		if err := rows.Scan(&i.Hardwareaddr, &i.Expiresat); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getQuotaUsage = `-- name: GetQuotaUsage :many
+SELECT HardwareAddr, SUM(CASE
+    WHEN StartTime >= $1::timestamp OR StopTime <= StartTime
+    THEN Ingress + Egress
+    ELSE (Ingress + Egress) * EXTRACT(EPOCH FROM StopTime - $1::timestamp)
+      / EXTRACT(EPOCH FROM StopTime - StartTime)
+  END)::bigint AS Bytes
+FROM Usage
+WHERE StopTime > $1::timestamp
+GROUP BY HardwareAddr
+`
+
+type GetQuotaUsageRow struct {
+	Hardwareaddr int64
+	Bytes        int64
+}
+
+// rows that started before start_time only count the share of
+// their traffic after it, as if it was spread evenly over the row
+func (q *Queries) GetQuotaUsage(ctx context.Context, startTime pgtype.Timestamp) ([]GetQuotaUsageRow, error) {
+	rows, err := q.db.Query(ctx, getQuotaUsage, startTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetQuotaUsageRow
+	for rows.Next() {
+		var i GetQuotaUsageRow
+		if err := rows.Scan(&i.Hardwareaddr, &i.Bytes); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getQuotas = `-- name: GetQuotas :many
+SELECT hardwareaddr, bytes, period, blockedat FROM Quota
+`
+
+func (q *Queries) GetQuotas(ctx context.Context) ([]Quota, error) {
+	rows, err := q.db.Query(ctx, getQuotas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Quota
+	for rows.Next() {
+		var i Quota
+		if err := rows.Scan(
+			&i.Hardwareaddr,
+			&i.Bytes,
+			&i.Period,
+			&i.Blockedat,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getRateLimits = `-- name: GetRateLimits :many
+SELECT hardwareaddr, ingress, egress FROM RateLimit
+`
+
+func (q *Queries) GetRateLimits(ctx context.Context) ([]Ratelimit, error) {
+	rows, err := q.db.Query(ctx, getRateLimits)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Ratelimit
+	for rows.Next() {
+		var i Ratelimit
+		if err := rows.Scan(&i.Hardwareaddr, &i.Ingress, &i.Egress); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSchedules = `-- name: GetSchedules :many
+SELECT name, days, starttime, stoptime, hardwareaddrs, domains FROM Schedule
+`
+
+func (q *Queries) GetSchedules(ctx context.Context) ([]Schedule, error) {
+	rows, err := q.db.Query(ctx, getSchedules)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Schedule
+	for rows.Next() {
+		var i Schedule
+		if err := rows.Scan(
+			&i.Name,
+			&i.Days,
+			&i.Starttime,
+			&i.Stoptime,
+			&i.Hardwareaddrs,
+			&i.Domains,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSetting = `-- name: GetSetting :one
+SELECT Value FROM Setting
+WHERE Name = $1
+`
+
+func (q *Queries) GetSetting(ctx context.Context, name string) (string, error) {
+	row := q.db.QueryRow(ctx, getSetting, name)
+	var value string
+	err := row.Scan(&value)
+	return value, err
+}
+
+const getTopDestinations = `-- name: GetTopDestinations :many
+SELECT Remote, RemotePort, Proto, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets
+FROM Flow
+WHERE StopTime >= $1 AND StartTime < $2
+  AND ($3::bigint IS NULL OR HardwareAddr = $3)
+GROUP BY Remote, RemotePort, Proto
+ORDER BY SUM(Ingress + Egress) DESC
+LIMIT $4
+`
+
+type GetTopDestinationsParams struct {
+	StartTime    pgtype.Timestamp
+	StopTime     pgtype.Timestamp
+	HardwareAddr pgtype.Int8
+	MaxRows      int32
+}
+
+type GetTopDestinationsRow struct {
+	Remote         netip.Addr
+	Remoteport     int32
+	Proto          int16
+	Ingress        int64
+	Egress         int64
+	Ingresspackets int64
+	Egresspackets  int64
+}
+
+func (q *Queries) GetTopDestinations(ctx context.Context, arg GetTopDestinationsParams) ([]GetTopDestinationsRow, error) {
+	rows, err := q.db.Query(ctx, getTopDestinations,
+		arg.StartTime,
+		arg.StopTime,
+		arg.HardwareAddr,
+		arg.MaxRows,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetTopDestinationsRow
+	for rows.Next() {
+		var i GetTopDestinationsRow
+		if err := rows.Scan(
+			&i.Remote,
+			&i.Remoteport,
+			&i.Proto,
+			&i.Ingress,
+			&i.Egress,
+			&i.Ingresspackets,
+			&i.Egresspackets,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTopTalkers = `-- name: GetTopTalkers :many
+SELECT HardwareAddr, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets
+FROM Flow
+WHERE StopTime >= $1 AND StartTime < $2
+  AND ($3::bigint IS NULL OR HardwareAddr = $3)
+GROUP BY HardwareAddr
+ORDER BY SUM(Ingress + Egress) DESC
+LIMIT $4
+`
+
+type GetTopTalkersParams struct {
+	StartTime    pgtype.Timestamp
+	StopTime     pgtype.Timestamp
+	HardwareAddr pgtype.Int8
+	MaxRows      int32
+}
+
+type GetTopTalkersRow struct {
+	Hardwareaddr   int64
+	Ingress        int64
+	Egress         int64
+	Ingresspackets int64
+	Egresspackets  int64
+}
+
+func (q *Queries) GetTopTalkers(ctx context.Context, arg GetTopTalkersParams) ([]GetTopTalkersRow, error) {
+	rows, err := q.db.Query(ctx, getTopTalkers,
+		arg.StartTime,
+		arg.StopTime,
+		arg.HardwareAddr,
+		arg.MaxRows,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetTopTalkersRow
+	for rows.Next() {
+		var i GetTopTalkersRow
+		if err := rows.Scan(
+			&i.Hardwareaddr,
+			&i.Ingress,
+			&i.Egress,
+			&i.Ingresspackets,
+			&i.Egresspackets,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUsage = `-- name: GetUsage :one
+SELECT SUM(Ingress) AS Ingress, SUM(Egress) AS Egress FROM Usage
+`
+
+type GetUsageRow struct {
+	Ingress int64
+	Egress  int64
+}
+
+func (q *Queries) GetUsage(ctx context.Context) (GetUsageRow, error) {
+	row := q.db.QueryRow(ctx, getUsage)
+	var i GetUsageRow
+	err := row.Scan(&i.Ingress, &i.Egress)
+	return i, err
+}
+
+const getUsageByIface = `-- name: GetUsageByIface :many
+SELECT Iface, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress,
+  SUM(IngressPackets)::bigint AS IngressPackets, SUM(EgressPackets)::bigint AS EgressPackets,
+  SUM(IngressIPv4)::bigint AS IngressIPv4,
+  SUM(IngressIPv6)::bigint AS IngressIPv6,
+  SUM(IngressTcp)::bigint AS IngressTcp,
+  SUM(IngressUdp)::bigint AS IngressUdp,
+  SUM(IngressIcmp)::bigint AS IngressIcmp,
+  SUM(IngressOther)::bigint AS IngressOther,
+  SUM(EgressIPv4)::bigint AS EgressIPv4,
+  SUM(EgressIPv6)::bigint AS EgressIPv6,
+  SUM(EgressTcp)::bigint AS EgressTcp,
+  SUM(EgressUdp)::bigint AS EgressUdp,
+  SUM(EgressIcmp)::bigint AS EgressIcmp,
+  SUM(EgressOther)::bigint AS EgressOther
+FROM Usage
+GROUP BY Iface
+`
+
+type GetUsageByIfaceRow struct {
+	Iface          string
+	Ingress        int64
+	Egress         int64
+	Ingresspackets int64
+	Egresspackets  int64
+	Ingressipv4    int64
+	Ingressipv6    int64
+	Ingresstcp     int64
+	Ingressudp     int64
+	Ingressicmp    int64
+	Ingressother   int64
+	Egressipv4     int64
+	Egressipv6     int64
+	Egresstcp      int64
+	Egressudp      int64
+	Egressicmp     int64
+	Egressother    int64
+}
+
+func (q *Queries) GetUsageByIface(ctx context.Context) ([]GetUsageByIfaceRow, error) {
+	rows, err := q.db.Query(ctx, getUsageByIface)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUsageByIfaceRow
+	for rows.Next() {
+		var i GetUsageByIfaceRow
+		if err := rows.Scan(
+			&i.Iface,
+			&i.Ingress,
+			&i.Egress,
+			&i.Ingresspackets,
+			&i.Egresspackets,
+			&i.Ingressipv4,
+			&i.Ingressipv6,
+			&i.Ingresstcp,
+			&i.Ingressudp,
+			&i.Ingressicmp,
+			&i.Ingressother,
+			&i.Egressipv4,
+			&i.Egressipv6,
+			&i.Egresstcp,
+			&i.Egressudp,
+			&i.Egressicmp,
+			&i.Egressother,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUsageByMac = `-- name: GetUsageByMac :many
+SELECT HardwareAddr, SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress
+FROM Usage
+WHERE StopTime >= $1 AND StartTime < $2
+GROUP BY HardwareAddr
+`
+
+type GetUsageByMacParams struct {
+	StartTime pgtype.Timestamp
+	StopTime  pgtype.Timestamp
+}
+
+type GetUsageByMacRow struct {
+	Hardwareaddr int64
+	Ingress      int64
+	Egress       int64
+}
+
+func (q *Queries) GetUsageByMac(ctx context.Context, arg GetUsageByMacParams) ([]GetUsageByMacRow, error) {
+	rows, err := q.db.Query(ctx, getUsageByMac, arg.StartTime, arg.StopTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUsageByMacRow
+	for rows.Next() {
+		var i GetUsageByMacRow
+		if err := rows.Scan(&i.Hardwareaddr, &i.Ingress, &i.Egress); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUsageHistory = `-- name: GetUsageHistory :many
+SELECT HardwareAddr, date_trunc($1::text, StartTime)::timestamp AS Bucket,
+  SUM(Ingress)::bigint AS Ingress, SUM(Egress)::bigint AS Egress
+FROM Usage
+WHERE StopTime >= $2 AND StartTime < $3
+GROUP BY HardwareAddr, Bucket
+ORDER BY Bucket
+`
+
+type GetUsageHistoryParams struct {
+	Period    string
+	StartTime pgtype.Timestamp
+	StopTime  pgtype.Timestamp
+}
+
+type GetUsageHistoryRow struct {
+	Hardwareaddr int64
+	Bucket       pgtype.Timestamp
+	Ingress      int64
+	Egress       int64
+}
+
+func (q *Queries) GetUsageHistory(ctx context.Context, arg GetUsageHistoryParams) ([]GetUsageHistoryRow, error) {
+	rows, err := q.db.Query(ctx, getUsageHistory, arg.Period, arg.StartTime, arg.StopTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUsageHistoryRow
+	for rows.Next() {
+		var i GetUsageHistoryRow
+		if err := rows.Scan(
+			&i.Hardwareaddr,
+			&i.Bucket,
+			&i.Ingress,
+			&i.Egress,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const setQuotaBlockedAt = `-- name: SetQuotaBlockedAt :exec
+UPDATE Quota
+SET BlockedAt = $2
+WHERE HardwareAddr = $1
+`
+
+type SetQuotaBlockedAtParams struct {
+	Hardwareaddr int64
+	Blockedat    pgtype.Timestamp
+}
+
+func (q *Queries) SetQuotaBlockedAt(ctx context.Context, arg SetQuotaBlockedAtParams) error {
+	_, err := q.db.Exec(ctx, setQuotaBlockedAt, arg.Hardwareaddr, arg.Blockedat)
+	return err
+}
@@ -1,15 +1,195 @@
 CREATE TABLE IF NOT EXISTS Usage (
   HardwareAddr BIGINT NOT NULL,
+  Iface TEXT NOT NULL,
   StartTime TIMESTAMP NOT NULL,
   StopTime TIMESTAMP NOT NULL,
   Egress BIGINT NOT NULL,
-  Ingress BIGINT NOT NULL
+  Ingress BIGINT NOT NULL,
+  IngressPackets BIGINT NOT NULL DEFAULT 0,
+  EgressPackets BIGINT NOT NULL DEFAULT 0,
+  -- Ingress and Egress by address family, and by transport protocol
+  IngressIPv4 BIGINT NOT NULL DEFAULT 0,
+  IngressIPv6 BIGINT NOT NULL DEFAULT 0,
+  IngressTcp BIGINT NOT NULL DEFAULT 0,
+  IngressUdp BIGINT NOT NULL DEFAULT 0,
+  IngressIcmp BIGINT NOT NULL DEFAULT 0,
+  IngressOther BIGINT NOT NULL DEFAULT 0,
+  EgressIPv4 BIGINT NOT NULL DEFAULT 0,
+  EgressIPv6 BIGINT NOT NULL DEFAULT 0,
+  EgressTcp BIGINT NOT NULL DEFAULT 0,
+  EgressUdp BIGINT NOT NULL DEFAULT 0,
+  EgressIcmp BIGINT NOT NULL DEFAULT 0,
+  EgressOther BIGINT NOT NULL DEFAULT 0
 );
 
+-- CREATE TABLE leaves tables from older versions as they are
+ALTER TABLE Usage
+  ADD COLUMN IF NOT EXISTS Iface TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS IngressPackets BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressPackets BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressIPv4 BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressIPv6 BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressTcp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressUdp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressIcmp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS IngressOther BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressIPv4 BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressIPv6 BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressTcp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressUdp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressIcmp BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS EgressOther BIGINT NOT NULL DEFAULT 0;
+
+-- traffic of a device with a remote address, totalled between
+-- pushes. the ports devices pick for their side are left out
+CREATE TABLE IF NOT EXISTS Flow (
+  HardwareAddr BIGINT NOT NULL,
+  StartTime TIMESTAMP NOT NULL,
+  StopTime TIMESTAMP NOT NULL,
+  Remote INET NOT NULL,
+  -- zero for protocols without ports
+  RemotePort INTEGER NOT NULL,
+  -- IP protocol number
+  Proto SMALLINT NOT NULL,
+  Ingress BIGINT NOT NULL,
+  Egress BIGINT NOT NULL,
+  IngressPackets BIGINT NOT NULL,
+  EgressPackets BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS FlowStopTime ON Flow (StopTime);
+
 CREATE TABLE IF NOT EXISTS DnsBlackList (
-  Name TEXT NOT NULL UNIQUE
+  Name TEXT NOT NULL UNIQUE,
+  -- match only the name itself, not its subdomains
+  Exact BOOLEAN NOT NULL DEFAULT FALSE,
+  -- block response, empty for the configured default
+  Mode TEXT NOT NULL DEFAULT '',
+  -- NULL for blocks that don't expire
+  ExpiresAt TIMESTAMP
+);
+
+ALTER TABLE DnsBlackList
+  ADD COLUMN IF NOT EXISTS Exact BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN IF NOT EXISTS Mode TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS ExpiresAt TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS DnsList (
+  Name TEXT NOT NULL UNIQUE,
+  Path TEXT NOT NULL,
+  Format TEXT NOT NULL,
+  Mode TEXT NOT NULL DEFAULT '',
+  UpdatedAt TIMESTAMP NOT NULL
+);
+
+ALTER TABLE DnsList
+  ADD COLUMN IF NOT EXISTS Mode TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS DnsListEntry (
+  ListName TEXT NOT NULL REFERENCES DnsList (Name) ON DELETE CASCADE,
+  Name TEXT NOT NULL,
+  Exact BOOLEAN NOT NULL,
+  UNIQUE (ListName, Name)
+);
+
+CREATE TABLE IF NOT EXISTS Device (
+  HardwareAddr BIGINT NOT NULL UNIQUE,
+  -- empty for devices that haven't been named
+  Name TEXT NOT NULL DEFAULT '',
+  Tags TEXT[] NOT NULL,
+  -- host name from the DHCP lease
+  Hostname TEXT NOT NULL DEFAULT '',
+  -- last known addresses
+  Addrs INET[] NOT NULL,
+  FirstSeen TIMESTAMP NOT NULL,
+  LastSeen TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS DeviceName
+ON Device (Name) WHERE Name <> '';
+
+CREATE TABLE IF NOT EXISTS DeviceGroup (
+  Name TEXT NOT NULL,
+  HardwareAddr BIGINT NOT NULL,
+  UNIQUE (Name, HardwareAddr)
 );
 
+-- binds a list to devices, lists without a policy apply to every device
+CREATE TABLE IF NOT EXISTS DnsPolicy (
+  ListName TEXT NOT NULL REFERENCES DnsList (Name) ON DELETE CASCADE,
+  -- either a device or a device group
+  HardwareAddr BIGINT,
+  GroupName TEXT,
+  CHECK ((HardwareAddr IS NULL) != (GroupName IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS DnsPolicyHardwareAddr
+ON DnsPolicy (ListName, HardwareAddr) WHERE HardwareAddr IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS DnsPolicyGroupName
+ON DnsPolicy (ListName, GroupName) WHERE GroupName IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS DnsLog (
+  Time TIMESTAMP NOT NULL,
+  Client INET NOT NULL,
+  -- NULL if the client isn't in the neighbour table
+  HardwareAddr BIGINT,
+  Name TEXT NOT NULL,
+  Type TEXT NOT NULL,
+  Rcode TEXT NOT NULL,
+  Blocked BOOLEAN NOT NULL,
+  -- empty for blocked and cached responses
+  Upstream TEXT NOT NULL,
+  -- microseconds taken to answer
+  Latency BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS DnsLogTime ON DnsLog (Time);
+
 CREATE TABLE IF NOT EXISTS MacBlackList (
+  HardwareAddr BIGINT NOT NULL UNIQUE,
+  -- NULL for blocks that don't expire
+  ExpiresAt TIMESTAMP
+);
+
+ALTER TABLE MacBlackList
+  ADD COLUMN IF NOT EXISTS ExpiresAt TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS MacAllowList (
   HardwareAddr BIGINT NOT NULL UNIQUE
 );
+
+-- runtime settings that outlive restarts
+CREATE TABLE IF NOT EXISTS Setting (
+  Name TEXT NOT NULL UNIQUE,
+  Value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS CidrBlackList (
+  -- source or destination addresses to drop
+  Prefix CIDR NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS Quota (
+  HardwareAddr BIGINT NOT NULL UNIQUE,
+  Bytes BIGINT NOT NULL,
+  Period TEXT NOT NULL,
+  BlockedAt TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS RateLimit (
+  HardwareAddr BIGINT NOT NULL UNIQUE,
+  -- bytes per second, zero for no limit
+  Ingress BIGINT NOT NULL,
+  Egress BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS Schedule (
+  Name TEXT NOT NULL UNIQUE,
+  -- bitmask of the days the schedule starts on, bit 0 is sunday
+  Days INTEGER NOT NULL,
+  -- a stop before the start ends the next day
+  StartTime TIME NOT NULL,
+  StopTime TIME NOT NULL,
+  HardwareAddrs BIGINT[] NOT NULL,
+  Domains TEXT[] NOT NULL
+);
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Timestamp stores the wall clock time of t in local time, a zero t is NULL
+func Timestamp(t time.Time) pgtype.Timestamp {
+	if t.IsZero() {
+		return pgtype.Timestamp{}
+	}
+
+	return pgtype.Timestamp{
+		Time:  t.Local(),
+		Valid: true,
+	}
+}
+
+// LocalTime interprets the wall clock time of a TIMESTAMP
+// as local time, NULL is the zero time
+func LocalTime(ts pgtype.Timestamp) time.Time {
+	if !ts.Valid {
+		return time.Time{}
+	}
+
+	t := ts.Time
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+		t.Second(), t.Nanosecond(), time.Local)
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InTx runs f with queries in a transaction, which is committed
+// if f returns nil and rolled back otherwise
+func (q *Queries) InTx(ctx context.Context, f func(queries *Queries) error) error {
+	beginner, ok := q.db.(interface {
+		Begin(ctx context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return errors.New("database doesn't support transactions")
+	}
+
+	tx, err := beginner.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = f(q.WithTx(tx))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
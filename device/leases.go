@@ -0,0 +1,62 @@
+package device
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/cilium/cilium/pkg/mac"
+)
+
+type lease struct {
+	hwAddr   uint64
+	addr     netip.Addr
+	hostname string
+}
+
+// readLeases parses a dnsmasq lease file, lines are like
+// "<expiry> <mac> <ip> <hostname> <client id>". DHCPv6 leases
+// carry DUIDs instead of MACs so they're skipped
+func readLeases(path string) ([]lease, error) {
+	var leases []lease
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		m, err := mac.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		hwAddr, err := m.Uint64()
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+
+		l := lease{
+			hwAddr: uint64(hwAddr),
+			addr:   addr.Unmap(),
+		}
+		// dnsmasq writes * for clients that didn't send one
+		if fields[3] != "*" {
+			l.hostname = fields[3]
+		}
+		leases = append(leases, l)
+	}
+
+	return leases, scanner.Err()
+}
@@ -0,0 +1,430 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/config"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/event"
+	"sinanmohd.com/redq/neigh"
+	"sinanmohd.com/redq/oui"
+)
+
+// how often addresses are learned and changes are written to the database
+const learnInterval = time.Minute
+
+type Device struct {
+	HardwareAddr uint64
+	// empty for devices that haven't been named
+	Name string
+	Tags []string
+	// host name from the DHCP lease
+	Hostname string
+	// empty for unknown vendors and randomized addresses
+	Vendor     string
+	Randomized bool
+	Addrs      []netip.Addr
+	FirstSeen  time.Time
+	LastSeen   time.Time
+}
+
+// Info describes a device whether it's in the inventory or not
+type Info struct {
+	Name       string
+	Vendor     string
+	Randomized bool
+}
+
+// Inventory records the devices seen on the network
+type Inventory struct {
+	ctxDb   context.Context
+	queries *db.Queries
+	neigh   *neigh.Neigh
+	bus     *event.Bus
+	oui     *oui.Oui
+	// indexes of the interfaces devices are learned on
+	links  []int
+	leases string
+	mutex  sync.RWMutex
+	data   map[uint64]*Device
+	// maps names to devices
+	names map[string]uint64
+	// devices changed since they were last written
+	dirty map[uint64]bool
+}
+
+func New(cfg *config.Config, n *neigh.Neigh, o *oui.Oui, b *event.Bus, queries *db.Queries, ctxDb context.Context) (*Inventory, error) {
+	inv := Inventory{
+		ctxDb:   ctxDb,
+		queries: queries,
+		neigh:   n,
+		bus:     b,
+		oui:     o,
+		leases:  cfg.Device.Leases,
+		data:    make(map[uint64]*Device),
+		names:   make(map[string]uint64),
+		dirty:   make(map[uint64]bool),
+	}
+
+	// neighbours on other links, like the upstream
+	// router, aren't devices on the network
+	for _, name := range cfg.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Printf("lookup network: %s", err)
+			return nil, err
+		}
+		inv.links = append(inv.links, iface.Index)
+	}
+
+	devices, err := queries.GetDevices(ctxDb)
+	if err != nil {
+		log.Printf("reading device database: %s", err)
+		return nil, err
+	}
+	for _, entry := range devices {
+		dev := Device{
+			HardwareAddr: uint64(entry.Hardwareaddr),
+			Name:         entry.Name,
+			Tags:         entry.Tags,
+			Hostname:     entry.Hostname,
+			Vendor:       o.Vendor(uint64(entry.Hardwareaddr)),
+			Randomized:   oui.Randomized(uint64(entry.Hardwareaddr)),
+			Addrs:        entry.Addrs,
+			FirstSeen:    db.LocalTime(entry.Firstseen),
+			LastSeen:     db.LocalTime(entry.Lastseen),
+		}
+
+		inv.data[dev.HardwareAddr] = &dev
+		if dev.Name != "" {
+			inv.names[dev.Name] = dev.HardwareAddr
+		}
+	}
+
+	inv.learn()
+	return &inv, nil
+}
+
+// ValidName rejects names that could be mistaken for a MAC
+// address or the total the bandwidth and usage responses carry
+func ValidName(name string) error {
+	if name == "" {
+		return errors.New("empty device name")
+	}
+	if name == "total" {
+		return errors.New("device name is reserved")
+	}
+	if _, err := mac.ParseMAC(name); err == nil {
+		return errors.New("device name looks like a mac address")
+	}
+
+	return nil
+}
+
+// seen returns a device, adding it if it's new. the caller must hold the mutex
+func (inv *Inventory) seen(hwAddr uint64, now time.Time) *Device {
+	dev, ok := inv.data[hwAddr]
+	if !ok {
+		dev = &Device{
+			HardwareAddr: hwAddr,
+			Vendor:       inv.oui.Vendor(hwAddr),
+			Randomized:   oui.Randomized(hwAddr),
+			FirstSeen:    now,
+		}
+		inv.data[hwAddr] = dev
+		inv.bus.Publish(event.Event{
+			Kind:         event.DeviceSeen,
+			Time:         now,
+			HardwareAddr: hwAddr,
+		})
+	}
+
+	dev.LastSeen = now
+	inv.dirty[hwAddr] = true
+	return dev
+}
+
+// Observe is a usage hook, it marks the devices that
+// sent or received traffic since the last update as seen
+func (inv *Inventory) Observe(u *usage.Usage) {
+	var active []uint64
+	now := time.Now()
+
+	u.Mutex.RLock()
+	for key, value := range u.Data {
+		if value.BandwidthIngress > 0 || value.BandwidthEgress > 0 {
+			active = append(active, key.HardwareAddr)
+		}
+	}
+	u.Mutex.RUnlock()
+
+	inv.mutex.Lock()
+	for _, hwAddr := range active {
+		inv.seen(hwAddr, now)
+	}
+	inv.mutex.Unlock()
+}
+
+// learn updates the addresses and host names from the neighbours on
+// the configured interfaces and the DHCP leases, devices keep their last known
+// addresses when they're in neither
+func (inv *Inventory) learn() {
+	now := time.Now()
+	addrs := inv.neigh.Addrs(inv.links)
+	hostnames := make(map[uint64]string)
+
+	if inv.leases != "" {
+		leases, err := readLeases(inv.leases)
+		if err != nil {
+			log.Printf("reading dhcp leases: %s", err)
+		}
+		for _, l := range leases {
+			if !slices.Contains(addrs[l.hwAddr], l.addr) {
+				addrs[l.hwAddr] = append(addrs[l.hwAddr], l.addr)
+			}
+			if l.hostname != "" {
+				hostnames[l.hwAddr] = l.hostname
+			}
+		}
+	}
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	for hwAddr, devAddrs := range addrs {
+		// stale neighbours linger for a while, so only
+		// traffic counts as seeing devices that are known
+		dev, ok := inv.data[hwAddr]
+		if !ok {
+			dev = inv.seen(hwAddr, now)
+		}
+
+		slices.SortFunc(devAddrs, func(a, b netip.Addr) int {
+			return a.Compare(b)
+		})
+		if !slices.Equal(dev.Addrs, devAddrs) {
+			dev.Addrs = devAddrs
+			inv.dirty[hwAddr] = true
+		}
+		if hostname, ok := hostnames[hwAddr]; ok && dev.Hostname != hostname {
+			dev.Hostname = hostname
+			inv.dirty[hwAddr] = true
+		}
+	}
+}
+
+// save writes the devices that changed, they stay
+// dirty on failure so they're written next time
+func (inv *Inventory) save() {
+	var devices []Device
+
+	inv.mutex.Lock()
+	for hwAddr := range inv.dirty {
+		devices = append(devices, inv.copy(inv.data[hwAddr]))
+	}
+	inv.dirty = make(map[uint64]bool)
+	inv.mutex.Unlock()
+
+	for _, dev := range devices {
+		err := inv.enter(&dev)
+		if err != nil {
+			log.Printf("writing device: %s", err)
+
+			inv.mutex.Lock()
+			inv.dirty[dev.HardwareAddr] = true
+			inv.mutex.Unlock()
+		}
+	}
+}
+
+func (inv *Inventory) enter(dev *Device) error {
+	params := db.EnterDeviceParams{
+		Hardwareaddr: int64(dev.HardwareAddr),
+		Name:         dev.Name,
+		Tags:         dev.Tags,
+		Hostname:     dev.Hostname,
+		Addrs:        dev.Addrs,
+		Firstseen:    db.Timestamp(dev.FirstSeen),
+		Lastseen:     db.Timestamp(dev.LastSeen),
+	}
+	if params.Tags == nil {
+		params.Tags = []string{}
+	}
+	if params.Addrs == nil {
+		params.Addrs = []netip.Addr{}
+	}
+
+	return inv.queries.EnterDevice(inv.ctxDb, params)
+}
+
+// copy returns a copy that's safe to use without the mutex
+func (inv *Inventory) copy(dev *Device) Device {
+	ret := *dev
+	ret.Tags = slices.Clone(dev.Tags)
+	ret.Addrs = slices.Clone(dev.Addrs)
+
+	return ret
+}
+
+func (inv *Inventory) Run() {
+	ticker := time.NewTicker(learnInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-inv.ctxDb.Done():
+			return
+		case <-ticker.C:
+			inv.learn()
+			inv.save()
+		}
+	}
+}
+
+// Close writes the pending changes
+func Close(inv *Inventory) {
+	inv.save()
+}
+
+// update changes a device and writes it right away
+func (inv *Inventory) update(hwAddr uint64, change func(dev *Device) error) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	dev, ok := inv.data[hwAddr]
+	if !ok {
+		return errors.New("no such device")
+	}
+
+	updated := inv.copy(dev)
+	err := change(&updated)
+	if err != nil {
+		return err
+	}
+
+	err = inv.enter(&updated)
+	if err != nil {
+		log.Printf("writing device: %s", err)
+		return err
+	}
+
+	if dev.Name != "" {
+		delete(inv.names, dev.Name)
+	}
+	if updated.Name != "" {
+		inv.names[updated.Name] = hwAddr
+	}
+	*dev = updated
+	delete(inv.dirty, hwAddr)
+
+	return nil
+}
+
+// SetName names a device, an empty name removes it
+func (inv *Inventory) SetName(hwAddr uint64, name string) error {
+	if name != "" {
+		err := ValidName(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return inv.update(hwAddr, func(dev *Device) error {
+		if other, ok := inv.names[name]; ok && name != "" && other != hwAddr {
+			return errors.New("device name is taken")
+		}
+
+		dev.Name = name
+		return nil
+	})
+}
+
+func (inv *Inventory) SetTags(hwAddr uint64, tags []string) error {
+	return inv.update(hwAddr, func(dev *Device) error {
+		tags = slices.Clone(tags)
+		slices.Sort(tags)
+		dev.Tags = slices.Compact(tags)
+		return nil
+	})
+}
+
+// Forget removes a device, it's added again once it's seen
+func (inv *Inventory) Forget(hwAddr uint64) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	dev, ok := inv.data[hwAddr]
+	if !ok {
+		return errors.New("no such device")
+	}
+
+	err := inv.queries.DeleteDevice(inv.ctxDb, int64(hwAddr))
+	if err != nil {
+		log.Printf("deleting device: %s", err)
+		return err
+	}
+
+	if dev.Name != "" {
+		delete(inv.names, dev.Name)
+	}
+	delete(inv.data, hwAddr)
+	delete(inv.dirty, hwAddr)
+
+	return nil
+}
+
+// Lookup returns the hardware address of a named device
+func (inv *Inventory) Lookup(name string) (uint64, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	hwAddr, ok := inv.names[name]
+	return hwAddr, ok
+}
+
+// Name returns the name of a device, empty if it has none
+func (inv *Inventory) Name(hwAddr uint64) string {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	if dev, ok := inv.data[hwAddr]; ok {
+		return dev.Name
+	}
+
+	return ""
+}
+
+// Info returns the name and vendor of a device
+func (inv *Inventory) Info(hwAddr uint64) Info {
+	return Info{
+		Name:       inv.Name(hwAddr),
+		Vendor:     inv.oui.Vendor(hwAddr),
+		Randomized: oui.Randomized(hwAddr),
+	}
+}
+
+// List returns every device, most recently seen first
+func (inv *Inventory) List() []Device {
+	var devices []Device
+
+	inv.mutex.RLock()
+	for _, dev := range inv.data {
+		devices = append(devices, inv.copy(dev))
+	}
+	inv.mutex.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeen.After(devices[j].LastSeen)
+	})
+	return devices
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manualSource holds the names blocked one by one,
+// imported lists are sources named after the list
+const manualSource = ""
+
+// holdPrefix starts the sources of held names, which sort
+// right after manualSource. list names can't start with it
+const holdPrefix = "@"
+
+// entry is a blocked name of a source
+type entry struct {
+	// match only the name itself, not its subdomains
+	exact bool
+	// block response, empty for the configured default
+	mode string
+}
+
+type DnsBlackList struct {
+	// maps a source to its normalized names
+	data map[string]map[string]entry
+	// keys of data in lookup order, kept sorted by add and replace
+	sources []string
+	// names of the sources applied to every device
+	trie *trie
+	// lists bound to devices by a policy have a trie of their own
+	scoped   map[string]*trie
+	policies policies
+	// when the manually blocked names that expire are unblocked
+	expires map[string]time.Time
+	mutex   sync.RWMutex
+}
+
+// rules returns the rules of the names of a source for a base domain
+func rules(names map[string]entry, base string) (exact, wildcard *rule) {
+	e, ok := names[base]
+	if ok {
+		exact = &rule{mode: e.mode}
+	}
+	if ok && !e.exact {
+		wildcard = &rule{mode: e.mode}
+	}
+
+	e, ok = names[wildcardPrefix+base]
+	if ok && wildcard == nil {
+		wildcard = &rule{mode: e.mode}
+	}
+
+	return exact, wildcard
+}
+
+// update syncs the trie node of a domain in the trie the source belongs
+// to, the global trie merges every global source and the manually blocked
+// names sort first so their modes win. the caller must hold the mutex
+func (b *DnsBlackList) update(source, name string) {
+	var exact, wildcard *rule
+	base := strings.TrimPrefix(name, wildcardPrefix)
+
+	if t, ok := b.scoped[source]; ok {
+		exact, wildcard = rules(b.data[source], base)
+		t.set(base, exact, wildcard)
+		return
+	}
+
+	for _, source := range b.sources {
+		if _, ok := b.scoped[source]; ok {
+			continue
+		}
+
+		e, w := rules(b.data[source], base)
+		if exact == nil {
+			exact = e
+		}
+		if wildcard == nil {
+			wildcard = w
+		}
+	}
+
+	b.trie.set(base, exact, wildcard)
+}
+
+func (b *DnsBlackList) add(source, name string, e entry) {
+	names, ok := b.data[source]
+	if !ok {
+		names = make(map[string]entry)
+		b.data[source] = names
+		b.addSource(source)
+	}
+
+	names[name] = e
+	b.update(source, name)
+}
+
+func (b *DnsBlackList) delete(source, name string) {
+	delete(b.data[source], name)
+	b.update(source, name)
+}
+
+// replace swaps every name of a source, nil names removes the source
+func (b *DnsBlackList) replace(source string, names map[string]entry) {
+	old, ok := b.data[source]
+	if names == nil {
+		delete(b.data, source)
+		b.deleteSource(source)
+	} else {
+		b.data[source] = names
+		if !ok {
+			b.addSource(source)
+		}
+	}
+
+	for name := range old {
+		b.update(source, name)
+	}
+	for name := range names {
+		b.update(source, name)
+	}
+}
+
+func (b *DnsBlackList) addSource(source string) {
+	i := sort.SearchStrings(b.sources, source)
+	b.sources = append(b.sources, "")
+	copy(b.sources[i+1:], b.sources[i:])
+	b.sources[i] = source
+}
+
+func (b *DnsBlackList) deleteSource(source string) {
+	i := sort.SearchStrings(b.sources, source)
+	if i < len(b.sources) && b.sources[i] == source {
+		b.sources = append(b.sources[:i], b.sources[i+1:]...)
+	}
+}
+
+// remove drops a source along with its policies
+func (b *DnsBlackList) remove(source string) {
+	b.replace(source, nil)
+	b.policies.forget(source)
+	b.scope(source, false)
+}
+
+// scope moves the names of a list from the global trie to a trie
+// of its own, or back if scoped is false
+func (b *DnsBlackList) scope(source string, scoped bool) {
+	if _, ok := b.scoped[source]; ok == scoped {
+		return
+	}
+
+	if scoped {
+		b.scoped[source] = newTrie()
+	} else {
+		delete(b.scoped, source)
+	}
+
+	for name := range b.data[source] {
+		// manualSource is always global
+		b.update(manualSource, name)
+		if scoped {
+			b.update(source, name)
+		}
+	}
+}
+
+// match returns the rule for a name queried by a device, global rules
+// win over the lists bound to the device. the caller must hold the mutex
+func (b *DnsBlackList) match(name string, hwAddr uint64, known bool) *rule {
+	r := b.trie.match(name)
+	if r != nil || !known || len(b.scoped) == 0 {
+		return r
+	}
+
+	for _, list := range b.policies.lists(hwAddr) {
+		t, ok := b.scoped[list]
+		if !ok {
+			continue
+		}
+
+		r = t.match(name)
+		if r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
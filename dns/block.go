@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
+)
+
+// blockTtl is the TTL of the answers made up for blocked names
+const blockTtl = 60
+
+// answer fills in A and AAAA answers for the questions of
+// resp, nil addresses leave the answer for their type empty
+func answer(resp *dns.Msg, ip4, ip6 net.IP) {
+	for _, question := range resp.Question {
+		hdr := dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    blockTtl,
+		}
+
+		switch {
+		case question.Qtype == dns.TypeA && ip4 != nil:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case question.Qtype == dns.TypeAAAA && ip6 != nil:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip6})
+		}
+	}
+}
+
+// blockResponse makes up the reply to a blocked query, an empty
+// mode falls back to the configured default
+func (d *Dns) blockResponse(req *dns.Msg, mode string) *dns.Msg {
+	resp := new(dns.Msg)
+	if mode == "" {
+		mode = d.blockMode
+	}
+
+	switch mode {
+	case config.BlockNoData:
+		resp.SetReply(req)
+	case config.BlockNxDomain:
+		resp.SetRcode(req, dns.RcodeNameError)
+	case config.BlockRefused:
+		resp.SetRcode(req, dns.RcodeRefused)
+	case config.BlockNull:
+		resp.SetReply(req)
+		answer(resp, net.IPv4zero, net.IPv6zero)
+	case config.BlockSinkhole:
+		resp.SetReply(req)
+		answer(resp, d.sinkholeIPv4, d.sinkholeIPv6)
+	default:
+		resp.SetReply(req)
+		ip := net.ParseIP(mode)
+		if ip.To4() != nil {
+			answer(resp, ip, nil)
+		} else {
+			answer(resp, nil, ip)
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,259 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
+)
+
+const (
+	// entries hit at least this often are refreshed
+	// before they expire if prefetching is enabled
+	prefetchHits = 3
+	// the fraction of the TTL left when prefetching kicks in
+	prefetchRatio = 10
+)
+
+type CacheStat struct {
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64
+	Evictions  uint64
+	Size       int
+	Capacity   int
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// DNSSEC records are only included if the client asked for them
+	do bool
+	cd bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        uint64
+	prefetching bool
+}
+
+// cache is a TTL respecting LRU cache of upstream responses, negative
+// responses are cached as described in RFC 2308
+type cache struct {
+	mutex          sync.Mutex
+	entries        map[cacheKey]*list.Element
+	lru            *list.List
+	maxTtl         time.Duration
+	maxNegativeTtl time.Duration
+	prefetch       bool
+	stat           CacheStat
+}
+
+func newCache(cfg *config.Cache) *cache {
+	return &cache{
+		entries:        make(map[cacheKey]*list.Element),
+		lru:            list.New(),
+		maxTtl:         cfg.MaxTtl,
+		maxNegativeTtl: cfg.MaxNegativeTtl,
+		prefetch:       cfg.Prefetch,
+		stat: CacheStat{
+			Capacity: cfg.Size,
+		},
+	}
+}
+
+func newCacheKey(req *dns.Msg) (cacheKey, bool) {
+	if len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+
+	question := req.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+		cd:     req.CheckingDisabled,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+
+	return key, true
+}
+
+// negativeTtl returns the TTL of a negative response from the SOA
+// record in its authority section, as described in RFC 2308 section 5
+func negativeTtl(resp *dns.Msg) (time.Duration, bool) {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := min(soa.Hdr.Ttl, soa.Minttl)
+		return time.Duration(ttl) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// responseTtl returns how long resp can be cached for
+func (c *cache) responseTtl(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeNameError,
+		resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0:
+		ttl, ok := negativeTtl(resp)
+		ttl = min(ttl, c.maxNegativeTtl)
+		return ttl, ok && ttl > 0
+	case resp.Rcode != dns.RcodeSuccess:
+		return 0, false
+	}
+
+	ttl := c.maxTtl
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+
+	return ttl, ttl > 0
+}
+
+// get returns a copy of the cached response with its TTLs reduced by the
+// time spent in the cache, prefetch is set if the caller should refresh it
+func (c *cache) get(req *dns.Msg) (resp *dns.Msg, prefetch bool) {
+	key, ok := newCacheKey(req)
+	if !ok {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stat.Misses++
+		return nil, false
+	}
+
+	e := elem.Value.(*cacheEntry)
+	age := time.Since(e.stored)
+	if age >= e.ttl {
+		c.remove(elem)
+		c.stat.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stat.Hits++
+	e.hits++
+
+	if c.prefetch && !e.prefetching && e.hits >= prefetchHits &&
+		e.ttl-age < e.ttl/prefetchRatio {
+		e.prefetching = true
+		prefetch = true
+	}
+
+	resp = e.msg.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	decrement := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if hdr.Ttl > decrement {
+				hdr.Ttl -= decrement
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return resp, prefetch
+}
+
+func (c *cache) set(req, resp *dns.Msg, prefetched bool) {
+	key, ok := newCacheKey(req)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ttl, ok := c.responseTtl(resp)
+	if !ok {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+		return
+	}
+
+	e := &cacheEntry{
+		key:    key,
+		msg:    resp.Copy(),
+		stored: time.Now(),
+		ttl:    ttl,
+	}
+	if prefetched {
+		c.stat.Prefetches++
+	}
+
+	elem, ok := c.entries[key]
+	if ok {
+		// keep the popularity, so hot entries keep getting prefetched
+		e.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+	c.stat.Size++
+	for c.stat.Size > c.stat.Capacity {
+		c.remove(c.lru.Back())
+		c.stat.Evictions++
+	}
+}
+
+// remove drops an entry, the caller must hold the mutex
+func (c *cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.stat.Size--
+}
+
+func (c *cache) flush() {
+	c.mutex.Lock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.stat.Size = 0
+	c.mutex.Unlock()
+}
+
+func (c *cache) stats() CacheStat {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.stat
+}
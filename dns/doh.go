@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
+)
+
+const dohContentType = "application/dns-message"
+
+// keep slow or idle clients from holding on to connections, a query
+// and its response are a few hundred bytes at most
+const (
+	dohReadTimeout  = 10 * time.Second
+	dohWriteTimeout = 10 * time.Second
+	dohIdleTimeout  = 2 * time.Minute
+)
+
+// dohWriter is the dns.ResponseWriter for DNS over HTTPS, as described
+// in RFC 8484, it holds on to the response so it can be sent over HTTP
+type dohWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	resp       *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohWriter) WriteMsg(resp *dns.Msg) error {
+	w.resp = resp
+	return nil
+}
+
+func (w *dohWriter) Write(buf []byte) (int, error) {
+	resp := new(dns.Msg)
+
+	err := resp.Unpack(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	w.resp = resp
+	return len(buf), nil
+}
+
+func (w *dohWriter) Close() error {
+	return nil
+}
+
+func (w *dohWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohWriter) TsigTimersOnly(bool) {
+}
+
+func (w *dohWriter) Hijack() {
+}
+
+func newDohServer(cfg *config.Listener, d *Dns) (*http.Server, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, d)
+
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: dohReadTimeout,
+		ReadTimeout:       dohReadTimeout,
+		WriteTimeout:      dohWriteTimeout,
+		IdleTimeout:       dohIdleTimeout,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}, nil
+}
+
+// minTtl returns the smallest TTL in resp, so HTTP caches
+// don't keep the response longer than DNS caches would
+func minTtl(resp *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
+
+func (d *Dns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	err = req.Unpack(buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		http.Error(w, "unknown local address", http.StatusInternalServerError)
+		return
+	}
+
+	dw := dohWriter{}
+	dw.localAddr, _ = net.ResolveTCPAddr("tcp", localAddr.String())
+	dw.remoteAddr, _ = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	d.ServeDNS(&dw, req)
+	if dw.resp == nil {
+		http.Error(w, "resolving failed", http.StatusBadGateway)
+		return
+	}
+
+	buf, err = dw.resp.Pack()
+	if err != nil {
+		log.Printf("packing dns over https response: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTtl(dw.resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.Write(buf)
+}
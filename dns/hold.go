@@ -0,0 +1,36 @@
+package dns
+
+// HoldDomains blocks domains until the reason is released, only for the
+// given devices if there are any. holding the same reason again replaces
+// the previous hold. holds aren't stored, so their owners must hold
+// again after a restart
+func (d *Dns) HoldDomains(reason string, domains []string, hwAddrs []uint64) error {
+	names := make(map[string]entry)
+	for _, domain := range domains {
+		name, err := Normalize(domain)
+		if err != nil {
+			return err
+		}
+
+		names[name] = entry{}
+	}
+
+	source := holdPrefix + reason
+	d.blackList.mutex.Lock()
+	defer d.blackList.mutex.Unlock()
+
+	d.blackList.remove(source)
+	for _, hwAddr := range hwAddrs {
+		d.blackList.policies.add(source, PolicyTarget{HardwareAddr: hwAddr})
+	}
+	d.blackList.scope(source, len(hwAddrs) > 0)
+	d.blackList.replace(source, names)
+
+	return nil
+}
+
+func (d *Dns) ReleaseDomains(reason string) {
+	d.blackList.mutex.Lock()
+	d.blackList.remove(holdPrefix + reason)
+	d.blackList.mutex.Unlock()
+}
@@ -0,0 +1,320 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/config"
+	"sinanmohd.com/redq/db"
+)
+
+const (
+	// 0.0.0.0 ads.example.com
+	FormatHosts = "hosts"
+	// ||example.com^
+	FormatAdBlock = "adblock"
+	// detect the format line by line, plain domains are accepted too
+	FormatAuto = "auto"
+)
+
+type ListStat struct {
+	Name      string
+	Path      string
+	Format    string
+	Mode      string
+	UpdatedAt time.Time
+	Entries   int
+}
+
+// names that hosts files map to themselves
+var hostsIgnored = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+func ValidFormat(format string) error {
+	switch format {
+	case FormatHosts, FormatAdBlock, FormatAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid list format '%s'", format)
+	}
+}
+
+// parseHostsLine returns the names of a hosts file line, they are
+// exact matches since hosts files can't express subdomains
+func parseHostsLine(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+
+	return fields[1:]
+}
+
+// parseAdBlockLine returns the domain of a ||example.com^ rule, rules
+// with options, paths or exceptions have no meaning for DNS and are skipped
+func parseAdBlockLine(line string) (string, bool) {
+	if !strings.HasPrefix(line, "||") {
+		return "", false
+	}
+
+	domain, ok := strings.CutSuffix(line[2:], "^")
+	if !ok || strings.ContainsAny(domain, "/*^$|") {
+		return "", false
+	}
+
+	return domain, true
+}
+
+// ParseList reads a blocklist, returning the normalized names and
+// whether they only match themselves along with the skipped lines
+func ParseList(r io.Reader, format string) (map[string]bool, int, error) {
+	names := make(map[string]bool)
+	skipped := 0
+
+	err := ValidFormat(format)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		line, _, _ = strings.Cut(line, " #")
+
+		var domains []string
+		exact := true
+		if domain, ok := parseAdBlockLine(line); ok && format != FormatHosts {
+			domains = []string{domain}
+			exact = false
+		} else if hosts := parseHostsLine(line); hosts != nil && format != FormatAdBlock {
+			domains = hosts
+		} else if format == FormatAuto && !strings.ContainsAny(line, " \t") {
+			domains = []string{line}
+		}
+
+		if domains == nil {
+			skipped++
+			continue
+		}
+
+		for _, domain := range domains {
+			name, err := Normalize(domain)
+			if err != nil || hostsIgnored[name] || strings.HasPrefix(name, wildcardPrefix) {
+				skipped++
+				continue
+			}
+
+			// a subdomain match covers the exact one as well
+			exactOnly, ok := names[name]
+			names[name] = exact && (!ok || exactOnly)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return names, skipped, nil
+}
+
+func (d *Dns) loadLists() error {
+	modes := make(map[string]string)
+	dnsLists, err := d.queries.GetDnsLists(d.ctxDb)
+	if err != nil {
+		return err
+	}
+	for _, list := range dnsLists {
+		modes[list.Name] = list.Mode
+	}
+
+	entries, err := d.queries.GetDnsListEntries(d.ctxDb)
+	if err != nil {
+		return err
+	}
+
+	lists := make(map[string]map[string]entry)
+	for _, e := range entries {
+		names, ok := lists[e.Listname]
+		if !ok {
+			names = make(map[string]entry)
+			lists[e.Listname] = names
+		}
+
+		names[e.Name] = entry{
+			exact: e.Exact,
+			mode:  modes[e.Listname],
+		}
+	}
+
+	for list, names := range lists {
+		d.blackList.replace(list, names)
+	}
+
+	return nil
+}
+
+// ImportList reads a blocklist file from the list directory and stores
+// it under name, importing the same name again replaces the previous
+// entries of the list. mode is the block mode of every entry, empty for
+// the configured default
+func (d *Dns) ImportList(name, path, format, mode string) (int, error) {
+	if name == manualSource {
+		return 0, errors.New("empty list name")
+	}
+	if strings.HasPrefix(name, holdPrefix) {
+		return 0, fmt.Errorf("list names can't start with '%s'", holdPrefix)
+	}
+	if mode != "" {
+		err := config.ValidBlockMode(mode)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the path comes from the API, keep it from reaching
+	// anything outside the list directory
+	if !filepath.IsLocal(path) {
+		return 0, fmt.Errorf("list path must be relative to %s", d.listDir)
+	}
+	file, err := os.Open(filepath.Join(d.listDir, path))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	names, skipped, err := ParseList(file, format)
+	if err != nil {
+		return 0, err
+	}
+	if skipped > 0 {
+		log.Printf("importing dns list %s: skipped %d entries", name, skipped)
+	}
+
+	entries := make(map[string]entry, len(names))
+	params := make([]db.EnterDnsListEntriesParams, 0, len(names))
+	for domain, exact := range names {
+		entries[domain] = entry{
+			exact: exact,
+			mode:  mode,
+		}
+		params = append(params, db.EnterDnsListEntriesParams{
+			Listname: name,
+			Name:     domain,
+			Exact:    exact,
+		})
+	}
+
+	// a failed import leaves the previous entries of the list in place
+	err = d.queries.InTx(d.ctxDb, func(queries *db.Queries) error {
+		err := queries.EnterDnsList(d.ctxDb, db.EnterDnsListParams{
+			Name:   name,
+			Path:   path,
+			Format: format,
+			Mode:   mode,
+			Updatedat: pgtype.Timestamp{
+				Time:  time.Now(),
+				Valid: true,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		err = queries.DeleteDnsListEntries(d.ctxDb, name)
+		if err != nil {
+			return err
+		}
+
+		_, err = queries.EnterDnsListEntries(d.ctxDb, params)
+		return err
+	})
+	if err != nil {
+		log.Printf("importing dns list: %s", err)
+		return 0, err
+	}
+
+	d.blackList.mutex.Lock()
+	d.blackList.replace(name, entries)
+	d.blackList.mutex.Unlock()
+
+	return len(names), nil
+}
+
+// RefreshList imports a list again from the path it was imported from
+func (d *Dns) RefreshList(name string) (int, error) {
+	list, err := d.queries.GetDnsList(d.ctxDb, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errors.New("no such list")
+	} else if err != nil {
+		log.Printf("reading dns list: %s", err)
+		return 0, err
+	}
+
+	return d.ImportList(list.Name, list.Path, list.Format, list.Mode)
+}
+
+func (d *Dns) RemoveList(name string) error {
+	err := d.queries.DeleteDnsList(d.ctxDb, name)
+	if err != nil {
+		log.Printf("deleting dns list: %s", err)
+		return err
+	}
+
+	// the policies of the list are deleted along with it
+	d.blackList.mutex.Lock()
+	d.blackList.remove(name)
+	d.blackList.mutex.Unlock()
+
+	return nil
+}
+
+func (d *Dns) Lists() ([]ListStat, error) {
+	var stats []ListStat
+
+	lists, err := d.queries.GetDnsLists(d.ctxDb)
+	if err != nil {
+		log.Printf("reading dns lists: %s", err)
+		return nil, err
+	}
+
+	d.blackList.mutex.RLock()
+	for _, list := range lists {
+		stats = append(stats, ListStat{
+			Name:      list.Name,
+			Path:      list.Path,
+			Format:    list.Format,
+			Mode:      list.Mode,
+			UpdatedAt: list.Updatedat.Time,
+			Entries:   len(d.blackList.data[list.Name]),
+		})
+	}
+	d.blackList.mutex.RUnlock()
+
+	return stats, nil
+}
@@ -2,122 +2,374 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
 	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/neigh"
 )
 
-type DnsBlackList struct {
-	data  map[string]bool
-	mutex sync.RWMutex
-}
-
 type Dns struct {
-	server    dns.Server
-	config    *dns.ClientConfig
-	queries   *db.Queries
-	ctxDb     context.Context
-	blackList DnsBlackList
+	servers      []*dns.Server
+	httpServer   *http.Server
+	resolver     *resolver
+	queries      *db.Queries
+	ctxDb        context.Context
+	listDir      string
+	neigh        *neigh.Neigh
+	blackList    DnsBlackList
+	blockMode    string
+	sinkholeIPv4 net.IP
+	sinkholeIPv6 net.IP
+	// nil if caching is disabled
+	cache *cache
+	// nil if query logging is disabled
+	queryLog *queryLog
 }
 
 func (d *Dns) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	var resp *dns.Msg
+	var upstream string
 	var err error
+	start := time.Now()
+
+	resp := d.block(w.RemoteAddr(), req)
+	blocked := resp != nil
+	if !blocked {
+		resp, upstream, err = d.resolve(req)
+		if err != nil {
+			resp = new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeServerFailure)
+		}
+	}
+
+	if d.queryLog != nil {
+		d.queryLog.add(w.RemoteAddr(), req, resp, blocked, upstream, time.Since(start))
+	}
+	write(w, req, resp)
+}
+
+// block returns the block response if any question
+// is blacklisted for the device the query came from
+func (d *Dns) block(addr net.Addr, req *dns.Msg) *dns.Msg {
+	var hwAddr uint64
+	var known bool
+
+	// only look the device up if there are lists bound to devices
+	d.blackList.mutex.RLock()
+	scoped := len(d.blackList.scoped) > 0
+	d.blackList.mutex.RUnlock()
+	if ip, ok := neigh.AddrIP(addr); ok && scoped {
+		hwAddr, known = d.neigh.Lookup(ip)
+	}
 
 	d.blackList.mutex.RLock()
+	defer d.blackList.mutex.RUnlock()
+
 	for _, qustion := range req.Question {
-		_, ok := d.blackList.data[qustion.Name]
-		if ok == false {
-			continue
+		r := d.blackList.match(strings.ToLower(qustion.Name), hwAddr, known)
+		if r != nil {
+			return d.blockResponse(req, r.mode)
 		}
+	}
 
-		resp = new(dns.Msg)
-		resp.SetReply(req)
-		w.WriteMsg(resp)
-		d.blackList.mutex.RUnlock()
-		return
+	return nil
+}
+
+// write truncates responses too large for UDP clients,
+// so they know to retry over TCP
+func write(w dns.ResponseWriter, req *dns.Msg, resp *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+
+		resp.Truncate(size)
 	}
-	d.blackList.mutex.RUnlock()
 
-	client := new(dns.Client)
-	req.RecursionDesired = true
-	for _, upstream := range d.config.Servers {
-		resp, _, err = client.Exchange(req, net.JoinHostPort(upstream, d.config.Port))
-		if err == nil {
-			break
+	w.WriteMsg(resp)
+}
+
+// resolve answers from the cache if possible, hot entries about to expire
+// are refreshed in the background. the upstream is empty for cached answers
+func (d *Dns) resolve(req *dns.Msg) (*dns.Msg, string, error) {
+	if d.cache != nil {
+		resp, prefetch := d.cache.get(req)
+		if prefetch {
+			go d.prefetch(req.Copy())
+		}
+		if resp != nil {
+			return resp, "", nil
 		}
+	}
 
-		log.Printf("dns resolving: %s", err)
+	resp, upstream, err := d.resolver.exchange(req)
+	if err != nil {
+		return nil, "", err
 	}
+
+	if d.cache != nil {
+		d.cache.set(req, resp, false)
+	}
+	return resp, upstream, nil
+}
+
+func (d *Dns) prefetch(req *dns.Msg) {
+	resp, _, err := d.resolver.exchange(req)
 	if err != nil {
 		return
 	}
 
-	w.WriteMsg(resp)
+	d.cache.set(req, resp, true)
+}
+
+func (d *Dns) UpstreamStats() []UpstreamStat {
+	return d.resolver.stats()
 }
 
-func New(queries *db.Queries, ctxDb context.Context) (*Dns, error) {
+func (d *Dns) CacheStats() (CacheStat, bool) {
+	if d.cache == nil {
+		return CacheStat{}, false
+	}
+
+	return d.cache.stats(), true
+}
+
+func (d *Dns) FlushCache() {
+	if d.cache != nil {
+		d.cache.flush()
+	}
+}
+
+func New(cfg *config.Config, n *neigh.Neigh, queries *db.Queries, ctxDb context.Context) (*Dns, error) {
 	var d Dns
 	var err error
 
-	d.server = dns.Server{
-		Net:       "udp",
-		ReusePort: true,
-		Handler:   &d,
+	for _, network := range []string{"udp", "tcp"} {
+		d.servers = append(d.servers, &dns.Server{
+			Addr:      cfg.Dns.Addr,
+			Net:       network,
+			ReusePort: true,
+			Handler:   &d,
+		})
+	}
+
+	if cfg.Dns.Tls.Addr != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Dns.Tls.CertFile, cfg.Dns.Tls.KeyFile)
+		if err != nil {
+			log.Printf("loading dns over tls certificate: %s", err)
+			return nil, err
+		}
+
+		d.servers = append(d.servers, &dns.Server{
+			Addr:      cfg.Dns.Tls.Addr,
+			Net:       "tcp-tls",
+			ReusePort: true,
+			Handler:   &d,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		})
+	}
+
+	if cfg.Dns.Https.Addr != "" {
+		d.httpServer, err = newDohServer(&cfg.Dns.Https, &d)
+		if err != nil {
+			log.Printf("loading dns over https certificate: %s", err)
+			return nil, err
+		}
 	}
 
-	d.config, err = dns.ClientConfigFromFile("/etc/resolv.conf")
+	d.resolver, err = newResolver(&cfg.Dns.Upstream, cfg.Dns.ResolvConf)
 	if err != nil {
-		log.Printf("reading resolve.conf: %s", err)
+		log.Printf("configuring upstream dns servers: %s", err)
 		return nil, err
 	}
 
 	d.queries = queries
 	d.ctxDb = ctxDb
-	d.blackList.data = make(map[string]bool)
+	d.listDir = cfg.Dns.ListDir
+	d.neigh = n
+	d.blockMode = cfg.Dns.BlockMode
+	d.sinkholeIPv4 = net.ParseIP(cfg.Dns.SinkholeIPv4)
+	d.sinkholeIPv6 = net.ParseIP(cfg.Dns.SinkholeIPv6)
+	if cfg.Dns.Cache.Size > 0 {
+		d.cache = newCache(&cfg.Dns.Cache)
+	}
+	if cfg.Dns.Log.Enabled {
+		d.queryLog = newQueryLog(&cfg.Dns.Log, n, queries, ctxDb)
+	}
+	d.blackList.data = make(map[string]map[string]entry)
+	d.blackList.trie = newTrie()
+	d.blackList.scoped = make(map[string]*trie)
+	d.blackList.policies = newPolicies()
+	d.blackList.expires = make(map[string]time.Time)
 	blackList, err := d.queries.GetDnsBlackList(d.ctxDb)
 	if err != nil {
 		log.Printf("reading dns blacklist database: %s", err)
 		return nil, err
 	}
-	for _, entry := range blackList {
-		d.blackList.data[entry] = true
+	d.blackList.mutex.Lock()
+	for _, e := range blackList {
+		name, err := Normalize(e.Name)
+		if err != nil {
+			log.Printf("skipping dns blacklist entry %s: %s", e.Name, err)
+			continue
+		}
+
+		d.blackList.add(manualSource, name, entry{
+			exact: e.Exact,
+			mode:  e.Mode,
+		})
+		// blocks that expired while we were down are lifted right away
+		d.expireAt(name, db.LocalTime(e.Expiresat))
+	}
+	d.blackList.mutex.Unlock()
+
+	err = d.loadPolicies()
+	if err != nil {
+		log.Printf("reading dns policies database: %s", err)
+		return nil, err
+	}
+
+	err = d.loadLists()
+	if err != nil {
+		log.Printf("reading dns lists database: %s", err)
+		return nil, err
 	}
 
 	return &d, nil
 }
 
 func (d *Dns) Run() {
-	d.server.ListenAndServe()
+	var wg sync.WaitGroup
+
+	if d.queryLog != nil {
+		go d.queryLog.run()
+	}
+
+	for _, server := range d.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := server.ListenAndServe()
+			if err != nil {
+				log.Printf("serving dns over %s: %s", server.Net, err)
+			}
+		}()
+	}
+
+	if d.httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := d.httpServer.ListenAndServeTLS("", "")
+			if err != nil {
+				log.Printf("serving dns over https: %s", err)
+			}
+		}()
+	}
+
+	wg.Wait()
 }
 
-func (d *Dns) Block(domain string) error {
-	err := d.queries.EnterDnsBlackList(d.ctxDb, domain)
+// Block blocks a domain along with its subdomains, or only the domain
+// itself if exact is set. *.example.com blocks only the subdomains.
+// an empty mode uses the configured block mode, the block is lifted
+// at expiresAt unless it's zero
+func (d *Dns) Block(domain string, exact bool, mode string, expiresAt time.Time) error {
+	name, err := Normalize(domain)
+	if err != nil {
+		return err
+	}
+	if mode != "" {
+		err = config.ValidBlockMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.queries.EnterDnsBlackList(d.ctxDb, db.EnterDnsBlackListParams{
+		Name:      name,
+		Exact:     exact,
+		Mode:      mode,
+		Expiresat: db.Timestamp(expiresAt),
+	})
 	if err != nil {
 		log.Printf("adding dns blacklist entry: %s", err)
 		return err
 	}
 
 	d.blackList.mutex.Lock()
-	d.blackList.data[domain] = true
+	d.blackList.add(manualSource, name, entry{
+		exact: exact,
+		mode:  mode,
+	})
+	d.expireAt(name, expiresAt)
 	d.blackList.mutex.Unlock()
 
 	return nil
 }
 
 func (d *Dns) Unblock(domain string) error {
-	err := d.queries.DeleteDnsBlackList(d.ctxDb, domain)
+	name, err := Normalize(domain)
+	if err != nil {
+		return err
+	}
+
+	err = d.queries.DeleteDnsBlackList(d.ctxDb, name)
 	if err != nil {
 		log.Printf("deleting dns blacklist entry: %s", err)
 		return err
 	}
 
 	d.blackList.mutex.Lock()
-	delete(d.blackList.data, domain)
+	d.blackList.delete(manualSource, name)
+	d.expireAt(name, time.Time{})
 	d.blackList.mutex.Unlock()
 
 	return nil
 }
+
+// expireAt arranges for a manually blocked name to be unblocked at
+// expiresAt, replacing the previous expiry. the caller must hold the
+// blacklist mutex
+func (d *Dns) expireAt(name string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(d.blackList.expires, name)
+		return
+	}
+
+	d.blackList.expires[name] = expiresAt
+	time.AfterFunc(time.Until(expiresAt), func() {
+		d.expire(name, expiresAt)
+	})
+}
+
+func (d *Dns) expire(name string, expiresAt time.Time) {
+	d.blackList.mutex.Lock()
+	defer d.blackList.mutex.Unlock()
+
+	// the block was replaced or lifted in the meantime
+	if !d.blackList.expires[name].Equal(expiresAt) {
+		return
+	}
+
+	err := d.queries.DeleteDnsBlackList(d.ctxDb, name)
+	if err != nil {
+		log.Printf("deleting expired dns blacklist entry: %s", err)
+		return
+	}
+
+	d.blackList.delete(manualSource, name)
+	delete(d.blackList.expires, name)
+}
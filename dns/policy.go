@@ -0,0 +1,289 @@
+package dns
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/db"
+)
+
+// PolicyTarget is a device, or a device group if Group is set
+type PolicyTarget struct {
+	HardwareAddr uint64
+	Group        string
+}
+
+type PolicyStat struct {
+	HardwareAddrs []uint64
+	Groups        []string
+}
+
+// policies bind lists to devices and device groups
+type policies struct {
+	// maps a device to its lists
+	devices map[uint64]map[string]bool
+	// maps a group to its lists
+	groups map[string]map[string]bool
+	// maps a device to its groups
+	members map[uint64]map[string]bool
+}
+
+func newPolicies() policies {
+	return policies{
+		devices: make(map[uint64]map[string]bool),
+		groups:  make(map[string]map[string]bool),
+		members: make(map[uint64]map[string]bool),
+	}
+}
+
+func setAdd[K comparable](m map[K]map[string]bool, key K, value string) {
+	values, ok := m[key]
+	if !ok {
+		values = make(map[string]bool)
+		m[key] = values
+	}
+
+	values[value] = true
+}
+
+func setDelete[K comparable](m map[K]map[string]bool, key K, value string) {
+	delete(m[key], value)
+	if len(m[key]) == 0 {
+		delete(m, key)
+	}
+}
+
+func (p *policies) add(list string, target PolicyTarget) {
+	if target.Group != "" {
+		setAdd(p.groups, target.Group, list)
+	} else {
+		setAdd(p.devices, target.HardwareAddr, list)
+	}
+}
+
+func (p *policies) delete(list string, target PolicyTarget) {
+	if target.Group != "" {
+		setDelete(p.groups, target.Group, list)
+	} else {
+		setDelete(p.devices, target.HardwareAddr, list)
+	}
+}
+
+// bound reports whether any device or group is bound to list
+func (p *policies) bound(list string) bool {
+	for _, lists := range p.devices {
+		if lists[list] {
+			return true
+		}
+	}
+	for _, lists := range p.groups {
+		if lists[list] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forget drops every policy of a list
+func (p *policies) forget(list string) {
+	for hwAddr := range p.devices {
+		setDelete(p.devices, hwAddr, list)
+	}
+	for group := range p.groups {
+		setDelete(p.groups, group, list)
+	}
+}
+
+// lists returns the lists bound to a device directly or through its groups
+func (p *policies) lists(hwAddr uint64) []string {
+	var lists []string
+	seen := make(map[string]bool)
+
+	for list := range p.devices[hwAddr] {
+		seen[list] = true
+		lists = append(lists, list)
+	}
+	for group := range p.members[hwAddr] {
+		for list := range p.groups[group] {
+			if !seen[list] {
+				seen[list] = true
+				lists = append(lists, list)
+			}
+		}
+	}
+
+	// keep the winning mode stable when lists overlap
+	sort.Strings(lists)
+	return lists
+}
+
+func policyParams(target PolicyTarget) (pgtype.Int8, pgtype.Text) {
+	if target.Group != "" {
+		return pgtype.Int8{}, pgtype.Text{
+			String: target.Group,
+			Valid:  true,
+		}
+	}
+
+	return pgtype.Int8{
+		Int64: int64(target.HardwareAddr),
+		Valid: true,
+	}, pgtype.Text{}
+}
+
+func (d *Dns) loadPolicies() error {
+	groups, err := d.queries.GetDeviceGroups(d.ctxDb)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		setAdd(d.blackList.policies.members, uint64(group.Hardwareaddr), group.Name)
+	}
+
+	policies, err := d.queries.GetDnsPolicies(d.ctxDb)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		d.blackList.policies.add(policy.Listname, PolicyTarget{
+			HardwareAddr: uint64(policy.Hardwareaddr.Int64),
+			Group:        policy.Groupname.String,
+		})
+		d.blackList.scope(policy.Listname, true)
+	}
+
+	return nil
+}
+
+// AddPolicy applies a list only to the bound devices and
+// groups instead of every device on the network
+func (d *Dns) AddPolicy(list string, target PolicyTarget) error {
+	if list == manualSource {
+		return errors.New("empty list name")
+	}
+
+	hwAddr, group := policyParams(target)
+	err := d.queries.EnterDnsPolicy(d.ctxDb, db.EnterDnsPolicyParams{
+		Listname:     list,
+		Hardwareaddr: hwAddr,
+		Groupname:    group,
+	})
+	if err != nil {
+		log.Printf("adding dns policy: %s", err)
+		return err
+	}
+
+	d.blackList.mutex.Lock()
+	d.blackList.policies.add(list, target)
+	d.blackList.scope(list, true)
+	d.blackList.mutex.Unlock()
+
+	return nil
+}
+
+// RemovePolicy unbinds a list from a device or group, lists
+// left without policies apply to every device again
+func (d *Dns) RemovePolicy(list string, target PolicyTarget) error {
+	hwAddr, group := policyParams(target)
+	err := d.queries.DeleteDnsPolicy(d.ctxDb, db.DeleteDnsPolicyParams{
+		Listname:     list,
+		Hardwareaddr: hwAddr,
+		Groupname:    group,
+	})
+	if err != nil {
+		log.Printf("deleting dns policy: %s", err)
+		return err
+	}
+
+	d.blackList.mutex.Lock()
+	d.blackList.policies.delete(list, target)
+	d.blackList.scope(list, d.blackList.policies.bound(list))
+	d.blackList.mutex.Unlock()
+
+	return nil
+}
+
+func (d *Dns) Policies() map[string]PolicyStat {
+	stats := make(map[string]PolicyStat)
+
+	d.blackList.mutex.RLock()
+	for hwAddr, lists := range d.blackList.policies.devices {
+		for list := range lists {
+			// holds bind their names to devices too
+			if strings.HasPrefix(list, holdPrefix) {
+				continue
+			}
+
+			stat := stats[list]
+			stat.HardwareAddrs = append(stat.HardwareAddrs, hwAddr)
+			stats[list] = stat
+		}
+	}
+	for group, lists := range d.blackList.policies.groups {
+		for list := range lists {
+			stat := stats[list]
+			stat.Groups = append(stat.Groups, group)
+			stats[list] = stat
+		}
+	}
+	d.blackList.mutex.RUnlock()
+
+	return stats
+}
+
+func (d *Dns) AddToGroup(group string, hwAddr uint64) error {
+	if group == "" {
+		return errors.New("empty group name")
+	}
+
+	err := d.queries.EnterDeviceGroup(d.ctxDb, db.EnterDeviceGroupParams{
+		Name:         group,
+		Hardwareaddr: int64(hwAddr),
+	})
+	if err != nil {
+		log.Printf("adding device group member: %s", err)
+		return err
+	}
+
+	d.blackList.mutex.Lock()
+	setAdd(d.blackList.policies.members, hwAddr, group)
+	d.blackList.mutex.Unlock()
+
+	return nil
+}
+
+func (d *Dns) RemoveFromGroup(group string, hwAddr uint64) error {
+	err := d.queries.DeleteDeviceGroup(d.ctxDb, db.DeleteDeviceGroupParams{
+		Name:         group,
+		Hardwareaddr: int64(hwAddr),
+	})
+	if err != nil {
+		log.Printf("deleting device group member: %s", err)
+		return err
+	}
+
+	d.blackList.mutex.Lock()
+	setDelete(d.blackList.policies.members, hwAddr, group)
+	d.blackList.mutex.Unlock()
+
+	return nil
+}
+
+// Groups maps every device group to its members
+func (d *Dns) Groups() map[string][]uint64 {
+	groups := make(map[string][]uint64)
+
+	d.blackList.mutex.RLock()
+	for hwAddr, names := range d.blackList.policies.members {
+		for group := range names {
+			groups[group] = append(groups[group], hwAddr)
+		}
+	}
+	d.blackList.mutex.RUnlock()
+
+	return groups
+}
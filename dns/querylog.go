@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/neigh"
+)
+
+const (
+	// queries are written to the database in batches, every
+	// logFlushInterval or once logBatchSize queries are pending
+	logFlushInterval = 5 * time.Second
+	logBatchSize     = 1024
+	logPruneInterval = time.Hour
+	// upper bound of the entries a search returns
+	MaxLogEntries = 1000
+)
+
+var ErrLogDisabled = errors.New("dns query log is disabled")
+
+type LogEntry struct {
+	Time   time.Time
+	Client netip.Addr
+	// zero if the client wasn't in the neighbour table
+	HardwareAddr uint64
+	Name         string
+	Type         string
+	Rcode        string
+	Blocked      bool
+	Upstream     string
+	Latency      time.Duration
+}
+
+// LogSearch filters the query log, zero values match everything
+type LogSearch struct {
+	Start        time.Time
+	Stop         time.Time
+	Client       netip.Addr
+	HardwareAddr uint64
+	// matches the name and its subdomains
+	Name  string
+	Limit int
+}
+
+type queryLog struct {
+	mutex     sync.Mutex
+	pending   []db.EnterDnsLogParams
+	flushNow  chan struct{}
+	queries   *db.Queries
+	ctxDb     context.Context
+	neigh     *neigh.Neigh
+	retention time.Duration
+}
+
+func newQueryLog(cfg *config.Log, n *neigh.Neigh, queries *db.Queries, ctxDb context.Context) *queryLog {
+	return &queryLog{
+		flushNow:  make(chan struct{}, 1),
+		queries:   queries,
+		ctxDb:     ctxDb,
+		neigh:     n,
+		retention: cfg.Retention,
+	}
+}
+
+func (l *queryLog) add(addr net.Addr, req, resp *dns.Msg, blocked bool, upstream string, latency time.Duration) {
+	if len(req.Question) == 0 {
+		return
+	}
+	client, ok := neigh.AddrIP(addr)
+	if !ok {
+		return
+	}
+
+	question := req.Question[0]
+	params := db.EnterDnsLogParams{
+		Time: pgtype.Timestamp{
+			Time:  time.Now(),
+			Valid: true,
+		},
+		Client:   client,
+		Name:     strings.ToLower(question.Name),
+		Type:     dns.TypeToString[question.Qtype],
+		Rcode:    dns.RcodeToString[resp.Rcode],
+		Blocked:  blocked,
+		Upstream: upstream,
+		Latency:  latency.Microseconds(),
+	}
+	if hwAddr, ok := l.neigh.Lookup(client); ok {
+		params.Hardwareaddr = pgtype.Int8{
+			Int64: int64(hwAddr),
+			Valid: true,
+		}
+	}
+
+	l.mutex.Lock()
+	l.pending = append(l.pending, params)
+	full := len(l.pending) >= logBatchSize
+	l.mutex.Unlock()
+
+	if full {
+		select {
+		case l.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the pending queries, they're dropped on failure
+// so an unreachable database can't grow them without bound
+func (l *queryLog) flush() error {
+	l.mutex.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	_, err := l.queries.EnterDnsLog(l.ctxDb, pending)
+	return err
+}
+
+func (l *queryLog) prune() error {
+	if l.retention == 0 {
+		return nil
+	}
+
+	return l.queries.DeleteDnsLog(l.ctxDb, pgtype.Timestamp{
+		Time:  time.Now().Add(-l.retention),
+		Valid: true,
+	})
+}
+
+func (l *queryLog) run() {
+	flushTicker := time.NewTicker(logFlushInterval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(logPruneInterval)
+	defer pruneTicker.Stop()
+
+	err := l.prune()
+	if err != nil {
+		log.Printf("pruning dns query log: %s", err)
+	}
+
+	for {
+		select {
+		case <-l.ctxDb.Done():
+			return
+		case <-flushTicker.C:
+		case <-l.flushNow:
+		case <-pruneTicker.C:
+			err = l.prune()
+			if err != nil {
+				log.Printf("pruning dns query log: %s", err)
+			}
+			continue
+		}
+
+		err = l.flush()
+		if err != nil {
+			log.Printf("writing dns query log: %s", err)
+		}
+	}
+}
+
+// SearchLog returns the newest queries matching s
+func (d *Dns) SearchLog(s LogSearch) ([]LogEntry, error) {
+	var entries []LogEntry
+
+	if d.queryLog == nil {
+		return nil, ErrLogDisabled
+	}
+
+	// include the queries still waiting for the next batch
+	err := d.queryLog.flush()
+	if err != nil {
+		log.Printf("writing dns query log: %s", err)
+		return nil, err
+	}
+
+	params := db.GetDnsLogParams{
+		StartTime: pgtype.Timestamp{
+			Time:  s.Start,
+			Valid: true,
+		},
+		StopTime: pgtype.Timestamp{
+			Time:  s.Stop,
+			Valid: true,
+		},
+		MaxRows: MaxLogEntries,
+	}
+	if s.Stop.IsZero() {
+		params.StopTime.Time = time.Now().Add(time.Minute)
+	}
+	if s.Client.IsValid() {
+		client := s.Client.Unmap()
+		params.Client = &client
+	}
+	if s.HardwareAddr != 0 {
+		params.HardwareAddr = pgtype.Int8{
+			Int64: int64(s.HardwareAddr),
+			Valid: true,
+		}
+	}
+	if s.Name != "" {
+		name, err := Normalize(s.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		params.Name = pgtype.Text{
+			String: strings.TrimPrefix(name, wildcardPrefix),
+			Valid:  true,
+		}
+	}
+	if s.Limit > 0 && s.Limit < MaxLogEntries {
+		params.MaxRows = int32(s.Limit)
+	}
+
+	rows, err := d.queries.GetDnsLog(d.ctxDb, params)
+	if err != nil {
+		log.Printf("reading dns query log: %s", err)
+		return nil, err
+	}
+	for _, row := range rows {
+		entries = append(entries, LogEntry{
+			Time:         row.Time.Time,
+			Client:       row.Client,
+			HardwareAddr: uint64(row.Hardwareaddr.Int64),
+			Name:         row.Name,
+			Type:         row.Type,
+			Rcode:        row.Rcode,
+			Blocked:      row.Blocked,
+			Upstream:     row.Upstream,
+			Latency:      time.Duration(row.Latency) * time.Microsecond,
+		})
+	}
+
+	return entries, nil
+}
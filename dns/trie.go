@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const wildcardPrefix = "*."
+
+// rule is what a matching name is blocked with
+type rule struct {
+	mode string
+}
+
+// trie stores domain names label by label starting from the
+// top level domain, so every subdomain of a name is in its subtree
+type trie struct {
+	children map[string]*trie
+	// the name of the node itself matches
+	exact *rule
+	// every name below the node matches
+	wildcard *rule
+}
+
+func newTrie() *trie {
+	return &trie{
+		children: make(map[string]*trie),
+	}
+}
+
+// Normalize case folds a domain or a *. prefixed wildcard and makes it
+// fully qualified, so callers don't have to remember the trailing dot
+func Normalize(domain string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(domain))
+	if name == "" {
+		return "", errors.New("empty domain")
+	}
+
+	base := strings.TrimPrefix(name, wildcardPrefix)
+	base = dns.Fqdn(base)
+	if base == "." {
+		return "", errors.New("refusing to match the root domain")
+	}
+	if _, ok := dns.IsDomainName(base); !ok {
+		return "", errors.New("invalid domain")
+	}
+	for _, c := range base {
+		if !validDomainChar(c) {
+			return "", errors.New("invalid domain")
+		}
+	}
+
+	if strings.HasPrefix(name, wildcardPrefix) {
+		return wildcardPrefix + base, nil
+	}
+	return base, nil
+}
+
+// validDomainChar is stricter than dns.IsDomainName,
+// which allows anything as long as it's escaped
+func validDomainChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.'
+}
+
+func reversedLabels(name string) []string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return labels
+}
+
+func (t *trie) node(name string, create bool) *trie {
+	node := t
+
+	for _, label := range reversedLabels(name) {
+		child, ok := node.children[label]
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			child = newTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+
+	return node
+}
+
+// set updates the rules of the node for name,
+// nodes left without rules or children are pruned
+func (t *trie) set(name string, exact, wildcard *rule) {
+	if exact != nil || wildcard != nil {
+		node := t.node(name, true)
+		node.exact = exact
+		node.wildcard = wildcard
+		return
+	}
+
+	node := t.node(name, false)
+	if node == nil {
+		return
+	}
+	node.exact = nil
+	node.wildcard = nil
+	t.prune(reversedLabels(name))
+}
+
+func (t *trie) prune(labels []string) bool {
+	if len(labels) > 0 {
+		child, ok := t.children[labels[0]]
+		if ok && child.prune(labels[1:]) {
+			delete(t.children, labels[0])
+		}
+	}
+
+	return t.exact == nil && t.wildcard == nil && len(t.children) == 0
+}
+
+// match returns the rule of a fully qualified, lower case name if
+// it's either in the trie or a subdomain of a wildcard entry
+func (t *trie) match(name string) *rule {
+	node := t
+	labels := reversedLabels(name)
+
+	for i, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			return nil
+		}
+		node = child
+
+		if node.wildcard != nil && i < len(labels)-1 {
+			return node.wildcard
+		}
+	}
+
+	return node.exact
+}
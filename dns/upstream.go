@@ -0,0 +1,344 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"sinanmohd.com/redq/config"
+)
+
+const (
+	// failing upstreams are skipped for backoffMin, doubling
+	// with every consecutive failure up to backoffMax
+	backoffMin = time.Second
+	backoffMax = 5 * time.Minute
+	// weight of a new sample in the moving latency average
+	latencyWeight = 8
+)
+
+type UpstreamStat struct {
+	Addr     string
+	Queries  uint64
+	Failures uint64
+	// moving average of successful exchanges
+	Latency time.Duration
+	// zero if the upstream is healthy
+	RetryAt time.Time
+}
+
+type upstream struct {
+	addr     string
+	exchange func(req *dns.Msg) (*dns.Msg, error)
+	// consecutive failures
+	failures uint
+	stat     UpstreamStat
+}
+
+// resolver spreads queries over the upstreams according to strategy
+type resolver struct {
+	mutex     sync.Mutex
+	strategy  string
+	upstreams []*upstream
+	// round robin position
+	next int
+}
+
+func newDnsClient(network string, timeout time.Duration, tlsConfig *tls.Config) *dns.Client {
+	return &dns.Client{
+		Net:       network,
+		Timeout:   timeout,
+		TLSConfig: tlsConfig,
+	}
+}
+
+// newUpstream parses a bare host with an optional port, or a
+// udp://, tcp://, tls:// or https:// URL
+func newUpstream(addr string, timeout time.Duration) (*upstream, error) {
+	err := config.ValidUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upstream{addr: addr}
+	u.stat.Addr = addr
+
+	if !strings.Contains(addr, "://") {
+		// bracket IPv6 addresses, a URL would read their last group as
+		// the port
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		addr = "udp://" + addr
+	}
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host := parsed.Host
+	if parsed.Port() == "" {
+		port := "53"
+		if parsed.Scheme == "tls" {
+			port = "853"
+		}
+		host = net.JoinHostPort(parsed.Hostname(), port)
+	}
+
+	switch parsed.Scheme {
+	case "udp":
+		udpClient := newDnsClient("udp", timeout, nil)
+		tcpClient := newDnsClient("tcp", timeout, nil)
+		u.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+			resp, _, err := udpClient.Exchange(req, host)
+			if err == nil && resp.Truncated {
+				resp, _, err = tcpClient.Exchange(req, host)
+			}
+
+			return resp, err
+		}
+	case "tcp":
+		client := newDnsClient("tcp", timeout, nil)
+		u.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+			resp, _, err := client.Exchange(req, host)
+			return resp, err
+		}
+	case "tls":
+		client := newDnsClient("tcp-tls", timeout, &tls.Config{
+			ServerName: parsed.Hostname(),
+		})
+		u.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+			resp, _, err := client.Exchange(req, host)
+			return resp, err
+		}
+	case "https":
+		client := &http.Client{Timeout: timeout}
+		u.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+			return dohExchange(client, parsed.String(), req)
+		}
+	}
+
+	return u, nil
+}
+
+// dohExchange sends a query with the POST method of RFC 8484
+func dohExchange(client *http.Client, url string, req *dns.Msg) (*dns.Msg, error) {
+	// the ID should be zero to make responses cacheable
+	query := req.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := client.Post(url, dohContentType, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, httpResp.Status)
+	}
+	buf, err = io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	err = resp.Unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func newResolver(cfg *config.Upstream, resolvConf string) (*resolver, error) {
+	r := resolver{
+		strategy: cfg.Strategy,
+	}
+
+	servers := cfg.Servers
+	if len(servers) == 0 {
+		clientConfig, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			log.Printf("reading resolve.conf: %s", err)
+			return nil, err
+		}
+
+		for _, server := range clientConfig.Servers {
+			servers = append(servers, net.JoinHostPort(server, clientConfig.Port))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no upstream dns servers")
+	}
+
+	for _, server := range servers {
+		u, err := newUpstream(server, cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", server, err)
+		}
+
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	return &r, nil
+}
+
+// candidates returns the upstreams to try in order, upstreams backing
+// off after failures come last so they're only used as a last resort
+func (r *resolver) candidates(now time.Time) []*upstream {
+	var healthy, failing []*upstream
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	start := 0
+	if r.strategy == config.StrategyRoundRobin {
+		start = r.next
+		r.next = (r.next + 1) % len(r.upstreams)
+	}
+
+	for i := range r.upstreams {
+		u := r.upstreams[(start+i)%len(r.upstreams)]
+		if now.Before(u.stat.RetryAt) {
+			failing = append(failing, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if r.strategy == config.StrategyFastest {
+		// unmeasured upstreams have no latency, so they get probed first
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].stat.Latency < healthy[j].stat.Latency
+		})
+	}
+	sort.SliceStable(failing, func(i, j int) bool {
+		return failing[i].stat.RetryAt.Before(failing[j].stat.RetryAt)
+	})
+
+	return append(healthy, failing...)
+}
+
+func (r *resolver) report(u *upstream, latency time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	u.stat.Queries++
+	if err != nil {
+		u.stat.Failures++
+		u.failures++
+		backoff := min(backoffMin<<min(u.failures-1, 16), backoffMax)
+		u.stat.RetryAt = time.Now().Add(backoff)
+		log.Printf("dns resolving with %s: %s", u.addr, err)
+		return
+	}
+
+	u.failures = 0
+	u.stat.RetryAt = time.Time{}
+	if u.stat.Latency == 0 {
+		u.stat.Latency = latency
+	} else {
+		u.stat.Latency += (latency - u.stat.Latency) / latencyWeight
+	}
+}
+
+func (r *resolver) try(u *upstream, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.exchange(req)
+	r.report(u, time.Since(start), err)
+
+	return resp, err
+}
+
+// exchange returns the response along with the upstream that answered
+func (r *resolver) exchange(req *dns.Msg) (*dns.Msg, string, error) {
+	var resp *dns.Msg
+	var err error
+
+	req.RecursionDesired = true
+	candidates := r.candidates(time.Now())
+	if r.strategy == config.StrategyParallel {
+		return r.race(candidates, req)
+	}
+
+	for _, u := range candidates {
+		resp, err = r.try(u, req)
+		if err == nil {
+			return resp, u.addr, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+// race queries the healthy upstreams at once, or all of them
+// if none are healthy, and returns the first answer
+func (r *resolver) race(candidates []*upstream, req *dns.Msg) (*dns.Msg, string, error) {
+	type result struct {
+		resp *dns.Msg
+		addr string
+		err  error
+	}
+
+	now := time.Now()
+	healthy := candidates[:0:0]
+	r.mutex.Lock()
+	for _, u := range candidates {
+		if !now.Before(u.stat.RetryAt) {
+			healthy = append(healthy, u)
+		}
+	}
+	r.mutex.Unlock()
+	if len(healthy) > 0 {
+		candidates = healthy
+	}
+
+	// buffered so the losers don't block after the race is over
+	results := make(chan result, len(candidates))
+	for _, u := range candidates {
+		query := req.Copy()
+		go func() {
+			resp, err := r.try(u, query)
+			results <- result{resp, u.addr, err}
+		}()
+	}
+
+	var err error
+	for range candidates {
+		res := <-results
+		if res.err == nil {
+			return res.resp, res.addr, nil
+		}
+		err = res.err
+	}
+
+	return nil, "", err
+}
+
+func (r *resolver) stats() []UpstreamStat {
+	var stats []UpstreamStat
+
+	r.mutex.Lock()
+	for _, u := range r.upstreams {
+		stats = append(stats, u.stat)
+	}
+	r.mutex.Unlock()
+
+	return stats
+}
@@ -0,0 +1,145 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sinanmohd.com/redq/bpf/usage"
+)
+
+// events a subscriber hasn't received yet, more are dropped
+// rather than holding up the publisher
+const queueSize = 64
+
+type Kind string
+
+const (
+	// the usage counters were updated
+	Bandwidth  Kind = "bandwidth"
+	DeviceSeen Kind = "device_seen"
+	// every block and hold is reported on its own, a device
+	// stays blocked while something else still holds it
+	Blocked       Kind = "blocked"
+	Unblocked     Kind = "unblocked"
+	QuotaExceeded Kind = "quota_exceeded"
+)
+
+type Event struct {
+	Kind Kind
+	Time time.Time
+	// zero for bandwidth updates
+	HardwareAddr uint64
+	// when a block is lifted, zero if it lasts until it's unblocked
+	ExpiresAt time.Time
+	// what held or released a device, empty for blocks
+	// made through the filter API
+	Reason string
+	// a copy of the counters on bandwidth updates, shared
+	// by every subscriber so it must not be modified
+	Usage map[usage.UsageKey]usage.UsageStat
+}
+
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	dropped atomic.Uint64
+	// the events the subscriber asked for
+	kinds map[Kind]bool
+}
+
+// Dropped returns the number of events dropped since it was last called
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+// Bus hands events to every subscriber
+type Bus struct {
+	mutex sync.RWMutex
+	subs  map[*Subscription]bool
+}
+
+func New() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]bool),
+	}
+}
+
+// Subscribe delivers the events of the given kinds on s.C
+func (b *Bus) Subscribe(kinds map[Kind]bool) *Subscription {
+	c := make(chan Event, queueSize)
+	s := Subscription{
+		C:     c,
+		c:     c,
+		kinds: kinds,
+	}
+
+	b.mutex.Lock()
+	b.subs[&s] = true
+	b.mutex.Unlock()
+
+	return &s
+}
+
+// Unsubscribe stops the events and closes s.C
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subs[s] {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Publish never blocks, subscribers that fall behind
+// miss events and find out through Dropped
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for s := range b.subs {
+		if !s.kinds[e.Kind] {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Updated is a usage.Hook, it hands subscribers a copy of the
+// counters taken once for all of them
+func (b *Bus) Updated(u *usage.Usage) {
+	idle := true
+	b.mutex.RLock()
+	for s := range b.subs {
+		if s.kinds[Bandwidth] {
+			idle = false
+			break
+		}
+	}
+	b.mutex.RUnlock()
+	if idle {
+		return
+	}
+
+	e := Event{
+		Kind:  Bandwidth,
+		Usage: make(map[usage.UsageKey]usage.UsageStat),
+	}
+	u.Mutex.RLock()
+	for key, value := range u.Data {
+		e.Usage[key] = value
+	}
+	u.Mutex.RUnlock()
+
+	b.Publish(e)
+}
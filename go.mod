@@ -3,17 +3,19 @@ module sinanmohd.com/redq
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/cilium/cilium v1.15.6
 	github.com/cilium/ebpf v0.15.0
 	github.com/dustin/go-humanize v1.0.1
 	github.com/jackc/pgx/v5 v5.6.0
 	github.com/miekg/dns v1.1.61
+	github.com/vishvananda/netlink v1.2.1-beta.2.0.20240524165444-4d4ba1473f21
 )
 
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/vishvananda/netlink v1.2.1-beta.2.0.20240524165444-4d4ba1473f21 // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
 	github.com/vishvananda/netns v0.0.4 // indirect
 	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/exp v0.0.0-20231206192017-f3f8817b8deb // indirect
@@ -0,0 +1,130 @@
+package neigh
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/mac"
+	"github.com/vishvananda/netlink"
+)
+
+// refreshInterval is how often Run reads the neighbour table
+// from the kernel again
+const refreshInterval = 5 * time.Second
+
+type neighbour struct {
+	hwAddr uint64
+	// index of the link the neighbour was seen on
+	linkIndex int
+}
+
+// Neigh maps IP addresses to hardware addresses
+// using the kernel ARP and NDP neighbour table
+type Neigh struct {
+	mutex sync.RWMutex
+	data  map[netip.Addr]neighbour
+}
+
+func New() (*Neigh, error) {
+	var n Neigh
+
+	err := n.refresh()
+	if err != nil {
+		log.Printf("reading neighbour table: %s", err)
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+func (n *Neigh) refresh() error {
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[netip.Addr]neighbour)
+	for _, neigh := range neighs {
+		if neigh.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 ||
+			len(neigh.HardwareAddr) != 6 {
+			continue
+		}
+
+		ip, ok := netip.AddrFromSlice(neigh.IP)
+		if !ok {
+			continue
+		}
+		hwAddr, err := mac.MAC(neigh.HardwareAddr).Uint64()
+		if err != nil {
+			continue
+		}
+
+		data[ip.Unmap()] = neighbour{
+			hwAddr:    uint64(hwAddr),
+			linkIndex: neigh.LinkIndex,
+		}
+	}
+
+	n.mutex.Lock()
+	n.data = data
+	n.mutex.Unlock()
+
+	return nil
+}
+
+// Run keeps the neighbour table fresh, lookups
+// never wait on netlink
+func (n *Neigh) Run() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := n.refresh()
+		if err != nil {
+			log.Printf("reading neighbour table: %s", err)
+		}
+	}
+}
+
+// Lookup returns the hardware address of a neighbour
+func (n *Neigh) Lookup(ip netip.Addr) (uint64, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	neigh, ok := n.data[ip.Unmap()]
+	return neigh.hwAddr, ok
+}
+
+// Addrs maps the neighbours seen on the given links to their IP addresses
+func (n *Neigh) Addrs(linkIndexes []int) map[uint64][]netip.Addr {
+	addrs := make(map[uint64][]netip.Addr)
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	for ip, neigh := range n.data {
+		if !slices.Contains(linkIndexes, neigh.linkIndex) {
+			continue
+		}
+
+		addrs[neigh.hwAddr] = append(addrs[neigh.hwAddr], ip)
+	}
+
+	return addrs
+}
+
+// AddrIP returns the IP address of a net.UDPAddr or net.TCPAddr
+func AddrIP(addr net.Addr) (netip.Addr, bool) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr().Unmap(), true
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr().Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
@@ -0,0 +1,102 @@
+package oui
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"sinanmohd.com/redq/config"
+)
+
+// an excerpt of the IEEE MA-L registry in its oui.txt format with a
+// few dozen common vendors, most devices need the full registry set
+// through the config
+//
+//go:embed oui.txt
+var embedded string
+
+// Oui looks up the vendors of hardware addresses
+type Oui struct {
+	data map[uint32]string
+}
+
+func New(cfg *config.Config) (*Oui, error) {
+	var o Oui
+	var err error
+
+	if cfg.Device.Oui == "" {
+		o.data, err = parse(strings.NewReader(embedded))
+		if err != nil {
+			log.Printf("parsing embedded oui database: %s", err)
+			return nil, err
+		}
+
+		log.Printf("using the embedded oui excerpt, set device.oui to the IEEE oui.txt to know every vendor")
+
+		return &o, nil
+	}
+
+	file, err := os.Open(cfg.Device.Oui)
+	if err != nil {
+		log.Printf("opening oui database: %s", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	o.data, err = parse(file)
+	if err != nil {
+		log.Printf("parsing oui database: %s", err)
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// parse reads the "XX-XX-XX   (hex)		Vendor" lines of an
+// IEEE oui.txt file and ignores the rest
+func parse(r io.Reader) (map[uint32]string, error) {
+	data := make(map[uint32]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		prefix, vendor, ok := strings.Cut(scanner.Text(), "(hex)")
+		if !ok {
+			continue
+		}
+
+		prefix = strings.ReplaceAll(strings.TrimSpace(prefix), "-", "")
+		if len(prefix) != 6 {
+			continue
+		}
+		oui, err := strconv.ParseUint(prefix, 16, 32)
+		if err != nil {
+			continue
+		}
+
+		data[uint32(oui)] = strings.TrimSpace(vendor)
+	}
+
+	return data, scanner.Err()
+}
+
+// Randomized reports locally administered addresses, which is what
+// devices use when they randomize their address for privacy
+func Randomized(hwAddr uint64) bool {
+	// the first octet is the least significant byte
+	return hwAddr&0x02 != 0
+}
+
+// Vendor returns the organization the address was assigned to,
+// empty if it's unknown or the address is randomized
+func (o *Oui) Vendor(hwAddr uint64) string {
+	if Randomized(hwAddr) {
+		return ""
+	}
+
+	oui := uint32(hwAddr&0xff)<<16 | uint32(hwAddr>>8&0xff)<<8 | uint32(hwAddr>>16&0xff)
+	return o.data[oui]
+}
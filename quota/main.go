@@ -0,0 +1,295 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/bpf/filter"
+	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/event"
+)
+
+// refreshInterval is how often the usage already pushed
+// to the database is fetched again for evaluation
+const refreshInterval = time.Minute
+
+type QuotaStat struct {
+	Bytes   uint64
+	Period  string
+	Used    uint64
+	Blocked bool
+}
+
+type quotaEntry struct {
+	QuotaStat
+	blockedAt time.Time
+}
+
+// periodUsage caches the usage stored in the database since
+// the start of a period for every device
+type periodUsage struct {
+	start     time.Time
+	fetchedAt time.Time
+	used      map[uint64]uint64
+}
+
+type Quota struct {
+	ctxDb   context.Context
+	queries *db.Queries
+	f       *filter.Filter
+	bus     *event.Bus
+	mutex   sync.Mutex
+	data    map[uint64]*quotaEntry
+	periods map[string]*periodUsage
+}
+
+func New(f *filter.Filter, b *event.Bus, queries *db.Queries, ctxDb context.Context) (*Quota, error) {
+	q := Quota{
+		ctxDb:   ctxDb,
+		queries: queries,
+		f:       f,
+		bus:     b,
+		data:    make(map[uint64]*quotaEntry),
+		periods: make(map[string]*periodUsage),
+	}
+
+	quotas, err := queries.GetQuotas(ctxDb)
+	if err != nil {
+		log.Printf("reading quota database: %s", err)
+		return nil, err
+	}
+	for _, entry := range quotas {
+		q.data[uint64(entry.Hardwareaddr)] = &quotaEntry{
+			QuotaStat: QuotaStat{
+				Bytes:   uint64(entry.Bytes),
+				Period:  entry.Period,
+				Blocked: entry.Blockedat.Valid,
+			},
+			blockedAt: db.LocalTime(entry.Blockedat),
+		}
+	}
+
+	return &q, nil
+}
+
+func ValidPeriod(period string) error {
+	switch period {
+	case "day", "week", "month":
+		return nil
+	default:
+		return fmt.Errorf("invalid period '%s'", period)
+	}
+}
+
+// periodStart returns the time the period containing now started
+func periodStart(now time.Time, period string) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch period {
+	case "day":
+		return midnight
+	case "week":
+		// weeks start on monday
+		offset := (int(midnight.Weekday()) + 6) % 7
+		return midnight.AddDate(0, 0, -offset)
+	default:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+}
+
+func (q *Quota) Set(mac uint64, bytes uint64, period string) error {
+	err := ValidPeriod(period)
+	if err != nil {
+		return err
+	}
+
+	err = q.queries.EnterQuota(q.ctxDb, db.EnterQuotaParams{
+		Hardwareaddr: int64(mac),
+		Bytes:        int64(bytes),
+		Period:       period,
+	})
+	if err != nil {
+		log.Printf("adding quota: %s", err)
+		return err
+	}
+
+	q.mutex.Lock()
+	entry, ok := q.data[mac]
+	if ok {
+		entry.Bytes = bytes
+		entry.Period = period
+	} else {
+		q.data[mac] = &quotaEntry{
+			QuotaStat: QuotaStat{
+				Bytes:  bytes,
+				Period: period,
+			},
+		}
+	}
+	q.mutex.Unlock()
+
+	return nil
+}
+
+// Clear removes the quota of a device and lifts
+// the block if the quota was the cause of it
+func (q *Quota) Clear(mac uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry, ok := q.data[mac]
+	if !ok {
+		return errors.New("no quota set")
+	}
+
+	// lift the block first, so a failure leaves the quota in
+	// place and clearing it again retries the unblock
+	if entry.Blocked {
+		err := q.f.Unblock(mac)
+		if err != nil {
+			return err
+		}
+		entry.Blocked = false
+	}
+
+	err := q.queries.DeleteQuota(q.ctxDb, int64(mac))
+	if err != nil {
+		log.Printf("deleting quota: %s", err)
+		return err
+	}
+
+	delete(q.data, mac)
+	return nil
+}
+
+func (q *Quota) List() map[uint64]QuotaStat {
+	list := make(map[uint64]QuotaStat)
+
+	q.mutex.Lock()
+	for key, value := range q.data {
+		list[key] = value.QuotaStat
+	}
+	q.mutex.Unlock()
+
+	return list
+}
+
+func (q *Quota) refresh(now time.Time) error {
+	for _, entry := range q.data {
+		start := periodStart(now, entry.Period)
+
+		p, ok := q.periods[entry.Period]
+		if ok && p.start.Equal(start) && now.Sub(p.fetchedAt) < refreshInterval {
+			continue
+		}
+
+		rows, err := q.queries.GetQuotaUsage(q.ctxDb, pgtype.Timestamp{
+			Time:  start,
+			Valid: true,
+		})
+		if err != nil {
+			return err
+		}
+
+		p = &periodUsage{
+			start:     start,
+			fetchedAt: now,
+			used:      make(map[uint64]uint64),
+		}
+		for _, row := range rows {
+			p.used[uint64(row.Hardwareaddr)] = uint64(row.Bytes)
+		}
+		q.periods[entry.Period] = p
+	}
+
+	return nil
+}
+
+func (q *Quota) setBlockedAt(mac uint64, blockedAt pgtype.Timestamp) error {
+	return q.queries.SetQuotaBlockedAt(q.ctxDb, db.SetQuotaBlockedAtParams{
+		Hardwareaddr: int64(mac),
+		Blockedat:    blockedAt,
+	})
+}
+
+// Evaluate is a usage.Hook, it blocks devices that went over their
+// quota and unblocks them once a new period starts
+func (q *Quota) Evaluate(u *usage.Usage) {
+	now := time.Now()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.data) == 0 {
+		return
+	}
+
+	err := q.refresh(now)
+	if err != nil {
+		log.Printf("fetching quota usage: %s", err)
+		return
+	}
+
+	live := make(map[uint64][]usage.UsageStat)
+	u.Mutex.RLock()
+	for key, value := range u.Data {
+		if _, ok := q.data[key.HardwareAddr]; ok {
+			live[key.HardwareAddr] = append(live[key.HardwareAddr], value)
+		}
+	}
+	u.Mutex.RUnlock()
+
+	for mac, entry := range q.data {
+		p := q.periods[entry.Period]
+		entry.Used = p.used[mac]
+		// the counters are pushed at midnight, when every period
+		// starts, so older ones are only left when that failed
+		for _, value := range live[mac] {
+			if !value.Since().Before(p.start) {
+				entry.Used += value.Ingress + value.Egress
+			}
+		}
+
+		if entry.Blocked && entry.blockedAt.Before(p.start) {
+			err = q.f.Unblock(mac)
+			if err != nil {
+				continue
+			}
+
+			err = q.setBlockedAt(mac, pgtype.Timestamp{})
+			if err != nil {
+				log.Printf("updating quota: %s", err)
+			}
+			entry.Blocked = false
+		}
+
+		// leave devices that are blocked for another reason alone
+		if entry.Blocked || entry.Used < entry.Bytes || q.f.IsBlocked(mac) {
+			continue
+		}
+
+		err = q.f.Block(mac, time.Time{})
+		if err != nil {
+			continue
+		}
+
+		err = q.setBlockedAt(mac, pgtype.Timestamp{
+			Time:  now,
+			Valid: true,
+		})
+		if err != nil {
+			log.Printf("updating quota: %s", err)
+		}
+		entry.Blocked = true
+		entry.blockedAt = now
+		q.bus.Publish(event.Event{
+			Kind:         event.QuotaExceeded,
+			HardwareAddr: mac,
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"sinanmohd.com/redq/bpf/usage"
+	"sinanmohd.com/redq/db"
+)
+
+// RateLimitStat is in bytes per second, zero for no limit. ingress
+// is traffic sent by the device and egress traffic sent to it. the
+// limit applies on every interface separately
+type RateLimitStat struct {
+	Ingress uint64
+	Egress  uint64
+}
+
+type RateLimit struct {
+	ctxDb   context.Context
+	queries *db.Queries
+	u       *usage.Usage
+	mutex   sync.Mutex
+	data    map[uint64]RateLimitStat
+}
+
+func New(u *usage.Usage, queries *db.Queries, ctxDb context.Context) (*RateLimit, error) {
+	r := RateLimit{
+		ctxDb:   ctxDb,
+		queries: queries,
+		u:       u,
+		data:    make(map[uint64]RateLimitStat),
+	}
+
+	limits, err := queries.GetRateLimits(ctxDb)
+	if err != nil {
+		log.Printf("reading rate limit database: %s", err)
+		return nil, err
+	}
+	for _, entry := range limits {
+		mac := uint64(entry.Hardwareaddr)
+		stat := RateLimitStat{
+			Ingress: uint64(entry.Ingress),
+			Egress:  uint64(entry.Egress),
+		}
+
+		err = u.SetRateLimit(mac, stat.Ingress, stat.Egress)
+		if err != nil {
+			return nil, err
+		}
+		r.data[mac] = stat
+	}
+
+	return &r, nil
+}
+
+// Set limits a device, replacing its previous limits
+func (r *RateLimit) Set(mac uint64, stat RateLimitStat) error {
+	if stat.Ingress == 0 && stat.Egress == 0 {
+		return errors.New("no limit to set")
+	}
+
+	err := r.queries.EnterRateLimit(r.ctxDb, db.EnterRateLimitParams{
+		Hardwareaddr: int64(mac),
+		Ingress:      int64(stat.Ingress),
+		Egress:       int64(stat.Egress),
+	})
+	if err != nil {
+		log.Printf("adding rate limit: %s", err)
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err = r.u.SetRateLimit(mac, stat.Ingress, stat.Egress)
+	if err != nil {
+		return err
+	}
+	r.data[mac] = stat
+
+	return nil
+}
+
+func (r *RateLimit) Remove(mac uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.data[mac]; !ok {
+		return errors.New("no rate limit for device")
+	}
+
+	err := r.queries.DeleteRateLimit(r.ctxDb, int64(mac))
+	if err != nil {
+		log.Printf("deleting rate limit: %s", err)
+		return err
+	}
+
+	err = r.u.SetRateLimit(mac, 0, 0)
+	if err != nil {
+		return err
+	}
+	delete(r.data, mac)
+
+	return nil
+}
+
+func (r *RateLimit) List() map[uint64]RateLimitStat {
+	list := make(map[uint64]RateLimitStat)
+
+	r.mutex.Lock()
+	for mac, stat := range r.data {
+		list[mac] = stat
+	}
+	r.mutex.Unlock()
+
+	return list
+}
@@ -0,0 +1,361 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"sinanmohd.com/redq/bpf/filter"
+	"sinanmohd.com/redq/db"
+	"sinanmohd.com/redq/dns"
+)
+
+const (
+	// how often schedules are checked for starting or stopping
+	tickInterval = 15 * time.Second
+	// layout of the start and stop times
+	TimeLayout = "15:04"
+	// holds are released by reason, so every schedule needs its own
+	reasonPrefix = "schedule:"
+)
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ScheduleStat blocks the devices, or only the domains if there are any,
+// from Start to Stop on Days. a Stop before Start ends the next day. the
+// domains are blocked for the devices, or every device if there are none
+type ScheduleStat struct {
+	Days          []time.Weekday
+	Start         time.Duration
+	Stop          time.Duration
+	HardwareAddrs []uint64
+	Domains       []string
+	Active        bool
+}
+
+type Schedule struct {
+	ctxDb   context.Context
+	queries *db.Queries
+	f       *filter.Filter
+	d       *dns.Dns
+	mutex   sync.Mutex
+	data    map[string]*ScheduleStat
+}
+
+// ParseDays accepts comma separated day names along with
+// daily, weekdays and weekends
+func ParseDays(value string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	seen := make(map[time.Weekday]bool)
+
+	for _, name := range strings.Split(strings.ToLower(value), ",") {
+		var add []time.Weekday
+
+		switch name = strings.TrimSpace(name); name {
+		case "daily":
+			add = []time.Weekday{time.Sunday, time.Monday, time.Tuesday,
+				time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+		case "weekdays":
+			add = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday,
+				time.Thursday, time.Friday}
+		case "weekends":
+			add = []time.Weekday{time.Saturday, time.Sunday}
+		default:
+			for i, dayName := range dayNames {
+				if name == dayName {
+					add = []time.Weekday{time.Weekday(i)}
+				}
+			}
+			if add == nil {
+				return nil, fmt.Errorf("invalid day '%s'", name)
+			}
+		}
+
+		for _, day := range add {
+			if !seen[day] {
+				seen[day] = true
+				days = append(days, day)
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func FormatDays(days []time.Weekday) string {
+	var names []string
+
+	for _, day := range days {
+		names = append(names, dayNames[day])
+	}
+
+	return strings.Join(names, ",")
+}
+
+// ParseTime parses a time of day in TimeLayout
+func ParseTime(value string) (time.Duration, error) {
+	t, err := time.Parse(TimeLayout, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func FormatTime(d time.Duration) string {
+	return time.Time{}.Add(d).Format(TimeLayout)
+}
+
+func daysMask(days []time.Weekday) int32 {
+	var mask int32
+
+	for _, day := range days {
+		mask |= 1 << day
+	}
+
+	return mask
+}
+
+func maskDays(mask int32) []time.Weekday {
+	var days []time.Weekday
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if mask&(1<<day) != 0 {
+			days = append(days, day)
+		}
+	}
+
+	return days
+}
+
+// active reports whether a window started by s on a
+// previous or the current day still covers now
+func (s *ScheduleStat) active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	for _, day := range s.Days {
+		// the day now falls on or the day before, for windows past midnight
+		for _, offset := range []int{0, -1} {
+			startDay := midnight.AddDate(0, 0, offset)
+			if startDay.Weekday() != day {
+				continue
+			}
+
+			start := startDay.Add(s.Start)
+			stop := startDay.Add(s.Stop)
+			if s.Stop <= s.Start {
+				stop = stop.AddDate(0, 0, 1)
+			}
+
+			if !now.Before(start) && now.Before(stop) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func New(f *filter.Filter, d *dns.Dns, queries *db.Queries, ctxDb context.Context) (*Schedule, error) {
+	s := Schedule{
+		ctxDb:   ctxDb,
+		queries: queries,
+		f:       f,
+		d:       d,
+		data:    make(map[string]*ScheduleStat),
+	}
+
+	schedules, err := queries.GetSchedules(ctxDb)
+	if err != nil {
+		log.Printf("reading schedule database: %s", err)
+		return nil, err
+	}
+	for _, entry := range schedules {
+		stat := ScheduleStat{
+			Days:    maskDays(entry.Days),
+			Start:   time.Duration(entry.Starttime.Microseconds) * time.Microsecond,
+			Stop:    time.Duration(entry.Stoptime.Microseconds) * time.Microsecond,
+			Domains: entry.Domains,
+		}
+		for _, hwAddr := range entry.Hardwareaddrs {
+			stat.HardwareAddrs = append(stat.HardwareAddrs, uint64(hwAddr))
+		}
+
+		s.data[entry.Name] = &stat
+	}
+
+	s.evaluate(time.Now())
+	return &s, nil
+}
+
+// apply holds or releases what a schedule blocks, a device that fails
+// doesn't keep the others from being held or released. the caller must
+// hold the mutex
+func (s *Schedule) apply(name string, stat *ScheduleStat, active bool) {
+	var errs []error
+	reason := reasonPrefix + name
+
+	if len(stat.Domains) > 0 {
+		if active {
+			err := s.d.HoldDomains(reason, stat.Domains, stat.HardwareAddrs)
+			if err != nil {
+				log.Printf("starting schedule %s: %s", name, err)
+				return
+			}
+		} else {
+			s.d.ReleaseDomains(reason)
+		}
+	} else {
+		for _, hwAddr := range stat.HardwareAddrs {
+			var err error
+
+			// the filter keeps the hold even if syncing the bpf
+			// map fails, so the state below still matches it
+			if active {
+				err = s.f.Hold(hwAddr, reason)
+			} else {
+				err = s.f.Release(hwAddr, reason)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	stat.Active = active
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("applying schedule %s: %s", name, err)
+	}
+}
+
+func (s *Schedule) evaluate(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, stat := range s.data {
+		active := stat.active(now)
+		if active != stat.Active {
+			s.apply(name, stat, active)
+		}
+	}
+}
+
+func (s *Schedule) Run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctxDb.Done():
+			return
+		case now := <-ticker.C:
+			s.evaluate(now)
+		}
+	}
+}
+
+// Set adds or replaces a schedule, it takes effect right away
+func (s *Schedule) Set(name string, stat ScheduleStat) error {
+	if name == "" {
+		return errors.New("empty schedule name")
+	}
+	if len(stat.Days) == 0 {
+		return errors.New("no days to schedule on")
+	}
+	if stat.Start == stat.Stop {
+		return errors.New("start and stop must differ")
+	}
+	if len(stat.HardwareAddrs) == 0 && len(stat.Domains) == 0 {
+		return errors.New("nothing to block")
+	}
+	for _, domain := range stat.Domains {
+		_, err := dns.Normalize(domain)
+		if err != nil {
+			return fmt.Errorf("%s: %w", domain, err)
+		}
+	}
+
+	params := db.EnterScheduleParams{
+		Name: name,
+		Days: daysMask(stat.Days),
+		Starttime: pgtype.Time{
+			Microseconds: stat.Start.Microseconds(),
+			Valid:        true,
+		},
+		Stoptime: pgtype.Time{
+			Microseconds: stat.Stop.Microseconds(),
+			Valid:        true,
+		},
+		Hardwareaddrs: []int64{},
+		Domains:       stat.Domains,
+	}
+	for _, hwAddr := range stat.HardwareAddrs {
+		params.Hardwareaddrs = append(params.Hardwareaddrs, int64(hwAddr))
+	}
+	if params.Domains == nil {
+		params.Domains = []string{}
+	}
+
+	err := s.queries.EnterSchedule(s.ctxDb, params)
+	if err != nil {
+		log.Printf("adding schedule: %s", err)
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, ok := s.data[name]
+	if ok && old.Active {
+		s.apply(name, old, false)
+	}
+
+	stat.Active = false
+	s.data[name] = &stat
+	if stat.active(time.Now()) {
+		s.apply(name, &stat, true)
+	}
+
+	return nil
+}
+
+// Remove deletes a schedule, lifting its blocks if it's active
+func (s *Schedule) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stat, ok := s.data[name]
+	if !ok {
+		return errors.New("no such schedule")
+	}
+
+	err := s.queries.DeleteSchedule(s.ctxDb, name)
+	if err != nil {
+		log.Printf("deleting schedule: %s", err)
+		return err
+	}
+
+	if stat.Active {
+		s.apply(name, stat, false)
+	}
+	delete(s.data, name)
+
+	return nil
+}
+
+func (s *Schedule) List() map[string]ScheduleStat {
+	list := make(map[string]ScheduleStat)
+
+	s.mutex.Lock()
+	for name, stat := range s.data {
+		list[name] = *stat
+	}
+	s.mutex.Unlock()
+
+	return list
+}